@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+// runAdopt adds the files of an archive downloaded before it had a
+// manifest, so later runs skip them. With -fetch, the galleries
+// are listed right away to match the files to their assets.
+func runAdopt(args []string) error {
+	flags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	fetch := flags.Bool("fetch", false, "List the galleries of adopted files to match them to their assets now, without downloading anything")
+	configFile := flags.String("config", "", "Config filename containing per site settings, for -fetch")
+	lockWait := flags.Duration("lock-wait", 0, "How long to wait for another instance to release the output directory")
+	_ = flags.Parse(args)
+
+	directory, err := archiveDirectory(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	galleries, err := adoptArchive(directory, *lockWait)
+	if err != nil {
+		return err
+	}
+
+	if !*fetch || len(galleries) == 0 {
+		return nil
+	}
+
+	config := artdl.Config{
+		Directory: directory,
+		Adopt:     true,
+		LockWait:  *lockWait,
+		UserAgent: "art-dl/" + version,
+	}
+	if *configFile != "" {
+		if err := artdl.LoadConfigFile(*configFile, &config); err != nil {
+			return err
+		}
+	}
+
+	for _, gallery := range galleries {
+		config.SeedURLs = append(config.SeedURLs, galleryURLs[gallery[0]](gallery[1]))
+	}
+
+	log.Printf("Matching adopted files of %d galleries", len(config.SeedURLs))
+
+	if err := scrape(&config); err != nil {
+		return err
+	}
+
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return err
+	}
+
+	var unmatched int
+	for _, entry := range manifest.Entries() {
+		if entry.URL == "" && entry.DuplicateOf == "" {
+			unmatched++
+		}
+	}
+	fmt.Printf("%d adopted files weren't matched to assets, and are matched again by later runs\n", unmatched)
+
+	return nil
+}
+
+// adoptArchive adds the untracked files of the archive to the
+// manifest while holding its lock.
+//
+// Returns the galleries with files that weren't matched to assets
+// yet, as site and user pairs.
+func adoptArchive(directory string, lockWait time.Duration) ([][2]string, error) {
+	if _, err := os.Stat(directory); err != nil {
+		return nil, err
+	}
+
+	lock, err := artdl.AcquireLock(directory, lockWait)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	sites := make([]string, 0, len(galleryURLs))
+	for site := range galleryURLs {
+		sites = append(sites, site)
+	}
+
+	count, err := artdl.AdoptFiles(directory, manifest, sites)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := manifest.Save(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[[2]string]bool)
+	galleries := make([][2]string, 0)
+	for _, entry := range manifest.Entries() {
+		gallery := [2]string{entry.Site, entry.User}
+		if entry.URL == "" && entry.DuplicateOf == "" && !seen[gallery] {
+			seen[gallery] = true
+			galleries = append(galleries, gallery)
+		}
+	}
+
+	fmt.Printf("Adopted %d files, %d galleries have files to match\n", count, len(galleries))
+
+	return galleries, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/dupes"
+	"github.com/vangroan/art-dl/processors"
+)
+
+// runDupes fingerprints the images in an archive and reports
+// clusters of near-duplicates.
+func runDupes(args []string) error {
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	threshold := flags.Float64("threshold", 0.9, "Minimum similarity from 0 to 1 for images to be considered duplicates")
+	algorithm := flags.String("algorithm", "phash", "Hash to compare images by, phash or dhash")
+	keepBest := flags.Bool("keep-best", false, "Delete all but the highest resolution copy in each cluster")
+	lockWait := flags.Duration("lock-wait", 0, "How long to wait for another instance to release the output directory")
+	_ = flags.Parse(args)
+
+	var compare dupes.Algorithm
+	switch *algorithm {
+	case "phash":
+		compare = dupes.ByPHash
+	case "dhash":
+		compare = dupes.ByDHash
+	default:
+		return fmt.Errorf("unknown algorithm '%s'", *algorithm)
+	}
+
+	directory, err := archiveDirectory(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	lock, err := artdl.AcquireLock(directory, *lockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return err
+	}
+
+	// Removed duplicates are marked in the catalog, when the
+	// archive has one. Reports don't need it.
+	var catalog *artdl.Catalog
+	if *keepBest {
+		if _, err := os.Stat(filepath.Join(directory, artdl.CatalogFilename)); os.IsNotExist(err) {
+			log.Printf("'%s' has no catalog, removed duplicates are only marked in the manifest", directory)
+		} else if catalog, err = artdl.OpenCatalog(directory); err != nil {
+			return err
+		}
+		defer catalog.Close()
+	}
+
+	images, err := fingerprintArchive(directory, manifest)
+	if err != nil {
+		return err
+	}
+
+	clusters := dupes.Cluster(images, compare, *threshold)
+
+	var removed int
+	for i, cluster := range clusters {
+		best := cluster[0]
+		fmt.Printf("Cluster %d:\n", i+1)
+		fmt.Printf("  keep %s (%dx%d, %s)\n", best.Path, best.Width, best.Height, artdl.FormatByteSize(best.Size))
+
+		for _, img := range cluster[1:] {
+			fmt.Printf("  dupe %s (%dx%d, %s)\n", img.Path, img.Width, img.Height, artdl.FormatByteSize(img.Size))
+
+			if *keepBest {
+				if err := removeDuplicate(directory, manifest, catalog, img.Path, best.Path); err != nil {
+					log.Println("Warning:", err)
+					continue
+				}
+				removed++
+			}
+		}
+	}
+
+	fmt.Printf("Found %d clusters of near-duplicates among %d images\n", len(clusters), len(images))
+	if *keepBest {
+		fmt.Printf("Removed %d duplicates\n", removed)
+	}
+
+	return manifest.Save()
+}
+
+// fingerprintArchive hashes every image in the archive. Hashes of
+// files in the manifest are stored there and reused while the
+// file size stays the same.
+func fingerprintArchive(directory string, manifest *artdl.Manifest) ([]dupes.Image, error) {
+	images := make([]dupes.Image, 0)
+
+	err := artdl.WalkArchive(directory, func(fp string, info os.FileInfo) error {
+		if !dupes.IsImage(fp) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(directory, fp)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(rel)
+
+		entry, tracked := manifest.Get(path)
+		img := dupes.Image{Path: path, Size: info.Size()}
+
+		if fingerprint, ok := storedFingerprint(entry, info); tracked && ok {
+			img.Fingerprint = fingerprint
+		} else {
+			fingerprint, err := dupes.FingerprintFile(fp)
+			if err != nil {
+				log.Println("Warning:", err)
+				return nil
+			}
+			img.Fingerprint = fingerprint
+
+			if tracked {
+				entry.Size = info.Size()
+				entry.Width = fingerprint.Width
+				entry.Height = fingerprint.Height
+				entry.DHash = fingerprint.DHash.String()
+				entry.PHash = fingerprint.PHash.String()
+				manifest.Add(entry)
+			}
+		}
+
+		images = append(images, img)
+
+		return nil
+	})
+
+	return images, err
+}
+
+// storedFingerprint reads the fingerprint from a manifest entry, if
+// it has one and the file hasn't changed size since.
+func storedFingerprint(entry artdl.ManifestEntry, info os.FileInfo) (dupes.Fingerprint, bool) {
+	if entry.PHash == "" || entry.DHash == "" || entry.Size != info.Size() {
+		return dupes.Fingerprint{}, false
+	}
+
+	dhash, err := dupes.ParseHash(entry.DHash)
+	if err != nil {
+		return dupes.Fingerprint{}, false
+	}
+
+	phash, err := dupes.ParseHash(entry.PHash)
+	if err != nil {
+		return dupes.Fingerprint{}, false
+	}
+
+	return dupes.Fingerprint{
+		DHash:  dhash,
+		PHash:  phash,
+		Width:  entry.Width,
+		Height: entry.Height,
+	}, true
+}
+
+// removeDuplicate deletes a near-duplicate and its thumbnail, and
+// marks it in the manifest so it isn't downloaded again.
+func removeDuplicate(directory string, manifest *artdl.Manifest, catalog *artdl.Catalog, path string, keep string) error {
+	fp := filepath.Join(directory, filepath.FromSlash(path))
+
+	if err := os.Remove(fp); err != nil {
+		return err
+	}
+
+	if err := os.Remove(processors.ThumbnailPath(fp)); err != nil && !os.IsNotExist(err) {
+		log.Println("Warning:", err)
+	}
+
+	if entry, ok := manifest.Get(path); ok {
+		entry.DuplicateOf = keep
+		manifest.Add(entry)
+	}
+
+	return catalog.Removed(path)
+}
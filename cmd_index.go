@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/index"
+)
+
+// runIndex generates a static site for browsing an archive.
+func runIndex(args []string) error {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	lockWait := flags.Duration("lock-wait", 0, "How long to wait for another instance to release the output directory")
+	_ = flags.Parse(args)
+
+	directory, err := archiveDirectory(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	lock, err := artdl.AcquireLock(directory, *lockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	stats, err := index.Generate(directory)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %d pages, %d unchanged, %d removed", stats.Written, stats.Unchanged, stats.Removed)
+	log.Println("Index:", filepath.Join(directory, index.Dirname, "index.html"))
+
+	return nil
+}
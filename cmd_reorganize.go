@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/reorganize"
+)
+
+// runReorganize moves the files of an archive into a new layout,
+// or resumes or undoes an interrupted reorganization.
+func runReorganize(args []string) error {
+	flags := flag.NewFlagSet("reorganize", flag.ExitOnError)
+	template := flags.String("template", "", "New layout of the files, eg. {site}/{user}/{date:2006}/{title}_{index}.{ext}")
+	link := flags.Bool("link", false, "Hardlink files into the new layout, keeping the old one")
+	dryRun := flags.Bool("dry-run", false, "List the moves without making them")
+	resume := flags.Bool("resume", false, "Finish an interrupted reorganization")
+	undo := flags.Bool("undo", false, "Revert an interrupted reorganization")
+	lockWait := flags.Duration("lock-wait", 0, "How long to wait for another instance to release the output directory")
+	_ = flags.Parse(args)
+
+	if *resume && *undo {
+		return fmt.Errorf("-resume and -undo can't be used together")
+	}
+	if *template == "" && !*resume && !*undo {
+		return fmt.Errorf("a -template is required")
+	}
+
+	directory, err := archiveDirectory(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	lock, err := artdl.AcquireLock(directory, *lockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := artdl.OpenCatalog(directory)
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	journal, err := reorganize.LoadJournal(directory)
+	if err != nil && err != artdl.ErrNotExist {
+		return err
+	}
+
+	if *resume || *undo {
+		if journal == nil {
+			return fmt.Errorf("no interrupted reorganization in '%s'", directory)
+		}
+		if *dryRun {
+			printMoves(journal, *undo)
+			return nil
+		}
+		if *undo {
+			log.Printf("Undoing %d moves into %s", len(journal.Moves), journal.Template)
+			return journal.Undo(manifest, catalog)
+		}
+		log.Printf("Resuming %d moves into %s", len(journal.Moves), journal.Template)
+		return journal.Apply(manifest, catalog)
+	}
+
+	if journal != nil {
+		return fmt.Errorf("a reorganization into %s was interrupted, run with -resume or -undo first", journal.Template)
+	}
+
+	layout, err := artdl.ParsePathTemplate(*template)
+	if err != nil {
+		return err
+	}
+
+	journal, err = reorganize.Plan(directory, manifest, catalog, layout, *link)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		printMoves(journal, false)
+		return nil
+	}
+
+	for _, skip := range journal.Skipped {
+		log.Printf("Warning: Leaving %s in place, %s", skip.Path, skip.Reason)
+	}
+
+	if len(journal.Moves) == 0 {
+		log.Println("Files are already laid out with", *template)
+		return nil
+	}
+
+	if err := journal.Save(); err != nil {
+		return err
+	}
+
+	log.Printf("Moving %d files into %s", len(journal.Moves), *template)
+
+	return journal.Apply(manifest, catalog)
+}
+
+// printMoves lists the moves of a journal, reversed when undoing.
+func printMoves(journal *reorganize.Journal, undo bool) {
+	verb := "move"
+	if journal.Link {
+		verb = "link"
+	}
+
+	for _, move := range journal.Moves {
+		switch {
+		case undo && journal.Link:
+			fmt.Printf("remove %s\n", move.To)
+		case undo:
+			fmt.Printf("%s %s -> %s\n", verb, move.To, move.From)
+		default:
+			fmt.Printf("%s %s -> %s\n", verb, move.From, move.To)
+		}
+	}
+
+	if undo {
+		fmt.Printf("%d files\n", len(journal.Moves))
+		return
+	}
+
+	for _, skip := range journal.Skipped {
+		fmt.Printf("skip %s: %s\n", skip.Path, skip.Reason)
+	}
+
+	fmt.Printf("%d files, %d left in place\n", len(journal.Moves), len(journal.Skipped))
+}
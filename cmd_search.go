@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+// searchResult is the JSON output of an artwork found by search.
+type searchResult struct {
+	Site        string    `json:"site"`
+	User        string    `json:"user"`
+	ID          string    `json:"id,omitempty"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	PageURL     string    `json:"page_url,omitempty"`
+	Tags        []string  `json:"tags"`
+	Published   time.Time `json:"published"`
+	Paths       []string  `json:"paths"`
+}
+
+// runSearch lists the artworks in the catalog of an archive that
+// match a search. The query is the first argument, followed by the
+// archive's directory.
+//
+// The catalog can't be searched while a download is running in the
+// archive.
+func runSearch(args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print results as JSON")
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("a query is required, eg. 'tag:dragon artist:someone'")
+	}
+
+	query, err := artdl.ParseQuery(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	directory, err := archiveDirectory(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	catalog, err := artdl.OpenCatalogReadOnly(directory)
+	if err == artdl.ErrNotExist {
+		return fmt.Errorf("'%s' has no catalog to search, it's created when downloading", directory)
+	}
+	if err == artdl.ErrCatalogInUse {
+		return fmt.Errorf("can't search '%s' while its catalog is in use by a running download", directory)
+	}
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	results, err := catalog.Search(query)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		output := make([]searchResult, 0, len(results))
+		for _, result := range results {
+			artwork := result.Artwork
+			output = append(output, searchResult{
+				Site:        artwork.Site,
+				User:        artwork.User,
+				ID:          artwork.ID,
+				Title:       artwork.Title,
+				Description: artwork.Description,
+				PageURL:     artwork.PageURL,
+				Tags:        append([]string{}, artwork.Tags...),
+				Published:   artwork.Published,
+				Paths:       storedPaths(result.Assets),
+			})
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+
+	for _, result := range results {
+		artwork := result.Artwork
+
+		date := "unknown date"
+		if !artwork.Published.IsZero() {
+			date = artwork.Published.Format("2006-01-02")
+		}
+		fmt.Printf("%s/%s  %s  %s\n", artwork.Site, artwork.User, date, artwork.Title)
+
+		if artwork.PageURL != "" {
+			fmt.Printf("  %s\n", artwork.PageURL)
+		}
+		for _, path := range storedPaths(result.Assets) {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+
+	fmt.Printf("Found %d artworks\n", len(results))
+
+	return nil
+}
+
+// storedPaths returns the paths of the assets that are stored.
+func storedPaths(assets []artdl.AssetRecord) []string {
+	paths := make([]string, 0, len(assets))
+	for _, asset := range assets {
+		if asset.Path != "" {
+			paths = append(paths, asset.Path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/processors"
+)
+
+// runThumbnails generates missing or outdated thumbnails for an
+// existing archive.
+func runThumbnails(args []string) error {
+	flags := flag.NewFlagSet("thumbnails", flag.ExitOnError)
+	size := flags.Int("size", processors.DefaultThumbnailSize, "Maximum length of the longest edge of thumbnails in pixels")
+	lockWait := flags.Duration("lock-wait", 0, "How long to wait for another instance to release the output directory")
+	_ = flags.Parse(args)
+
+	directory, err := archiveDirectory(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	lock, err := artdl.AcquireLock(directory, *lockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	generator := processors.NewThumbnailGenerator(*size)
+	var generated, failed int
+
+	err = artdl.WalkArchive(directory, func(fp string, info os.FileInfo) error {
+		ok, err := generator.Generate(fp)
+		if err != nil {
+			log.Println("Warning:", err)
+			failed++
+			return nil
+		}
+
+		if ok {
+			log.Println("Thumbnail:", processors.ThumbnailPath(fp))
+			generated++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Generated %d thumbnails, %d failed", generated, failed)
+
+	return nil
+}
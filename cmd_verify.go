@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/verify"
+)
+
+// runVerify checks the files of an archive against the manifest
+// and catalog, and reports missing, corrupt and untracked files.
+// With -repair, bad files are downloaded again from their galleries,
+// using the same processors as the original download.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Move corrupt files to the .corrupt folder and download missing and corrupt files again")
+	template := flags.String("template", "", "Layout the archive was downloaded with, for repairs. Default is each site's layout.")
+	configFile := flags.String("config", "", "Config filename containing per site settings, for repairs")
+	lockWait := flags.Duration("lock-wait", 0, "How long to wait for another instance to release the output directory")
+	var processing processorFlags
+	processing.register(flags)
+	_ = flags.Parse(args)
+
+	directory, err := archiveDirectory(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	report, repairs, err := verifyArchive(directory, *lockWait, *repair)
+	if err != nil {
+		return err
+	}
+
+	var missing, corrupt int
+	for _, problem := range report.Problems {
+		if problem.Kind == verify.Missing {
+			missing++
+		} else {
+			corrupt++
+		}
+		fmt.Printf("%-9s %s: %s\n", problem.Kind, problem.Entry.Path, problem.Reason)
+	}
+	for _, key := range report.Untracked {
+		fmt.Printf("%-9s %s\n", "untracked", key)
+	}
+
+	fmt.Printf("Checked %d files: %d missing, %d corrupt, %d untracked\n", report.Checked, missing, corrupt, len(report.Untracked))
+
+	if !*repair {
+		if len(report.Problems) > 0 {
+			return fmt.Errorf("%d files failed verification", len(report.Problems))
+		}
+		return nil
+	}
+
+	if len(repairs) == 0 {
+		return nil
+	}
+
+	config := artdl.Config{
+		Directory:  directory,
+		Template:   *template,
+		LockWait:   *lockWait,
+		UserAgent:  "art-dl/" + version,
+		Processors: processing.chain(),
+		URLs:       make(map[string]bool),
+	}
+	if *configFile != "" {
+		if err := artdl.LoadConfigFile(*configFile, &config); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, problem := range repairs {
+		config.URLs[problem.Entry.URL] = true
+
+		seed := galleryURLs[problem.Entry.Site](problem.Entry.User)
+		if !seen[seed] {
+			seen[seed] = true
+			config.SeedURLs = append(config.SeedURLs, seed)
+		}
+	}
+
+	log.Printf("Repairing %d files from %d galleries", len(repairs), len(config.SeedURLs))
+
+	if err := scrape(&config); err != nil {
+		return err
+	}
+
+	// Files no longer listed in their gallery can't be repaired
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, problem := range repairs {
+		if _, ok := manifest.FindURL(problem.Entry.URL); !ok {
+			log.Printf("Warning: Couldn't download '%s' again, for %s", problem.Entry.URL, problem.Entry.Path)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files couldn't be repaired", failed)
+	}
+
+	return nil
+}
+
+// verifyArchive verifies the archive while holding its lock, and
+// prepares the bad files to be downloaded again when repairing.
+//
+// Returns the problems to repair. Files of unknown sites, or without
+// a gallery, are left as they are.
+func verifyArchive(directory string, lockWait time.Duration, repair bool) (*verify.Report, []verify.Problem, error) {
+	if _, err := os.Stat(directory); err != nil {
+		return nil, nil, err
+	}
+
+	lock, err := artdl.AcquireLock(directory, lockWait)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Release()
+
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Archives from before the catalog have no checksums, and
+	// repairs record the new downloads in a new catalog
+	var catalog *artdl.Catalog
+	if repair {
+		catalog, err = artdl.OpenCatalog(directory)
+	} else {
+		catalog, err = artdl.OpenCatalogReadOnly(directory)
+	}
+	if err != nil && err != artdl.ErrNotExist {
+		return nil, nil, err
+	}
+	defer catalog.Close()
+
+	report, err := verify.Archive(directory, manifest, catalog)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !repair {
+		return report, nil, nil
+	}
+
+	problems := make([]verify.Problem, 0, len(report.Problems))
+	for _, problem := range report.Problems {
+		if _, ok := galleryURLs[problem.Entry.Site]; !ok || problem.Entry.User == "" || problem.Entry.URL == "" {
+			log.Printf("Warning: Can't repair '%s', its gallery isn't known", problem.Entry.Path)
+			continue
+		}
+		problems = append(problems, problem)
+	}
+
+	repairs, err := verify.Repair(directory, manifest, catalog, problems)
+	return report, repairs, err
+}
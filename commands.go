@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+)
+
+// commandFunc runs a subcommand with the arguments that
+// follow its name on the command line.
+type commandFunc func(args []string) error
+
+// commands maps subcommand names to their implementation.
+// Without a subcommand, the application scrapes galleries.
+var commands = map[string]commandFunc{
+	"adopt":      runAdopt,
+	"thumbnails": runThumbnails,
+	"dupes":      runDupes,
+	"index":      runIndex,
+	"reorganize": runReorganize,
+	"search":     runSearch,
+	"verify":     runVerify,
+}
+
+// lookupCommand returns the subcommand named by the first
+// command line argument, if any.
+func lookupCommand() (commandFunc, []string, bool) {
+	if len(os.Args) < 2 {
+		return nil, nil, false
+	}
+
+	command, ok := commands[os.Args[1]]
+	return command, os.Args[2:], ok
+}
+
+// archiveDirectory returns the output directory a subcommand
+// works on, given as the first positional argument or else
+// the current working directory.
+func archiveDirectory(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return os.Getwd()
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// AdoptFiles adds the files of an archive downloaded before it had a
+// manifest, laid out in site and user folders, to the manifest. Only
+// folders of the given sites are scanned, and files already in the
+// manifest are left alone.
+//
+// Adopted files don't know the URL they were downloaded from yet.
+// Sessions match them to the assets listed by scrapers, by gallery
+// and file name, and skip downloading them.
+//
+// Returns the number of files adopted.
+func AdoptFiles(directory string, manifest *Manifest, sites []string) (int, error) {
+	known := make(map[string]bool)
+	for _, site := range sites {
+		known[site] = true
+	}
+
+	var count int
+	err := WalkArchive(directory, func(fp string, info os.FileInfo) error {
+		if strings.HasSuffix(fp, SidecarSuffix) || isTempFilename(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(directory, fp)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		// Files are at least as deep as site/user/filename
+		parts := strings.Split(key, "/")
+		if len(parts) < 3 || !known[parts[0]] {
+			return nil
+		}
+		if _, ok := manifest.Get(key); ok {
+			return nil
+		}
+
+		manifest.Add(ManifestEntry{
+			Path:       key,
+			Site:       parts[0],
+			User:       parts[1],
+			Size:       info.Size(),
+			Downloaded: info.ModTime(),
+		})
+		count++
+
+		return nil
+	})
+
+	return count, err
+}
+
+// adoptions indexes the adopted files that weren't matched to an
+// asset yet, by gallery and lower case file name.
+type adoptions struct {
+	files map[string][]string
+	lock  *sync.Mutex // pointer to avoid copy
+}
+
+func newAdoptions(manifest *Manifest) *adoptions {
+	a := &adoptions{
+		files: make(map[string][]string),
+		lock:  &sync.Mutex{},
+	}
+
+	for _, entry := range manifest.Entries() {
+		if entry.URL == "" && entry.DuplicateOf == "" {
+			name := adoptionName(entry.Site, entry.User, path.Base(entry.Path))
+			a.files[name] = append(a.files[name], entry.Path)
+		}
+	}
+
+	return a
+}
+
+func adoptionName(site, user, filename string) string {
+	return galleryName(site, user) + "/" + strings.ToLower(filename)
+}
+
+// claim takes the adopted file with the asset's file name, if any.
+// Returns its path.
+func (a *adoptions) claim(asset *Asset) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	name := adoptionName(asset.Site, asset.User, asset.Filename())
+	paths := a.files[name]
+	if len(paths) == 0 {
+		return "", false
+	}
+
+	if len(paths) == 1 {
+		delete(a.files, name)
+	} else {
+		a.files[name] = paths[1:]
+	}
+
+	return paths[0], true
+}
+
+// checkAdopted matches the asset to an adopted file, which then
+// counts as downloaded from the asset's URL.
+func (s *Session) checkAdopted(asset *Asset) error {
+	if s.adoptions == nil {
+		return nil
+	}
+
+	key, ok := s.adoptions.claim(asset)
+	if !ok {
+		return nil
+	}
+
+	entry, ok := s.Manifest.Get(key)
+	if !ok {
+		return nil
+	}
+	if exists, err := s.Storage.Exists(key); err != nil || !exists {
+		return nil
+	}
+
+	entry.URL = asset.URL
+	s.Manifest.Add(entry)
+
+	var hash string
+	if storage, ok := s.Storage.(ReadableStorage); ok && s.Catalog != nil {
+		var err error
+		if hash, err = HashFile(storage, key); err != nil {
+			log.Println("Warning: Failed to hash file:", err)
+		}
+	}
+
+	if err := s.Catalog.Stored(asset.URL, key, entry.Size, hash); err != nil {
+		log.Println("Warning: Failed to update catalog:", err)
+	}
+
+	return &SkipError{URL: asset.URL, Reason: fmt.Sprintf("adopted '%s'", key)}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/vangroan/art-dl/internal/testutil"
+)
+
+// newAdoptedArchive creates an archive downloaded before it had a
+// manifest, with files of a known and an unknown site.
+func newAdoptedArchive(t *testing.T) string {
+	dir := t.TempDir()
+	for _, key := range []string{"deviantart/one/a.jpg", "deviantart/one/old/b.jpg", "other/one/c.jpg", "d.jpg"} {
+		testutil.WriteFile(t, filepath.Join(dir, filepath.FromSlash(key)), []byte("data"))
+	}
+	return dir
+}
+
+func TestAdoptFiles(t *testing.T) {
+	// Arrange
+	dir := newAdoptedArchive(t)
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	count, err := AdoptFiles(dir, manifest, []string{"deviantart"})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, count)
+	}
+	entry, ok := manifest.Get("deviantart/one/old/b.jpg")
+	if !ok || entry.Site != "deviantart" || entry.User != "one" || entry.Size != 4 {
+		t.Fatalf("Expected adopted entry, actual %+v", entry)
+	}
+}
+
+func TestSessionClaimsAdopted(t *testing.T) {
+	// Arrange
+	dir := newAdoptedArchive(t)
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AdoptFiles(dir, manifest, []string{"deviantart"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Save(); err != nil {
+		t.Fatal(err)
+	}
+	session, err := NewSession(&Config{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Never fetched, since the file is adopted
+	asset := Asset{URL: "http://127.0.0.1:0/B.jpg", Site: "deviantart", User: "one"}
+
+	// Act
+	_, err = session.Download(&asset, "{site}/{user}/{filename}")
+	if cerr := session.Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	// Assert
+	if !IsSkipped(err) {
+		t.Fatalf("Expected asset to be skipped, actual %v", err)
+	}
+	if entry, ok := session.Manifest.FindURL(asset.URL); !ok || entry.Path != "deviantart/one/old/b.jpg" {
+		t.Fatalf("Expected adopted file to be matched, actual %+v", entry)
+	}
+
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	if record, ok := catalog.FindURL(asset.URL); !ok || record.Path != "deviantart/one/old/b.jpg" || record.SHA256 == "" {
+		t.Fatalf("Expected catalog to record adopted file, actual %+v", record)
+	}
+}
+
+func TestSessionAdoptOnly(t *testing.T) {
+	// Arrange
+	session, err := NewSession(&Config{Directory: t.TempDir(), Adopt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	asset := Asset{URL: "http://127.0.0.1:0/new.jpg", Site: "deviantart", User: "one"}
+
+	// Act
+	_, err = session.Download(&asset, "{site}/{user}/{filename}")
+
+	// Assert
+	if !IsSkipped(err) {
+		t.Fatalf("Expected asset to be skipped, actual %v", err)
+	}
+}
@@ -0,0 +1,683 @@
+package common
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ComicInfoFilename is the metadata entry of CBZ archives,
+	// which most comic readers understand.
+	ComicInfoFilename string = "ComicInfo.xml"
+
+	// ArchiveInfoFilename is the metadata entry of ZIP archives.
+	ArchiveInfoFilename string = "metadata.json"
+)
+
+// entryPrefix matches the sequence number that keeps entries in
+// the order they were added, eg. "0001_" in "0001_image.jpg".
+var entryPrefix = regexp.MustCompile(`^(\d+)_`)
+
+// ArchiveStorage keeps each folder of files, such as a gallery
+// or a project, as a single ZIP or CBZ archive next to where the
+// folder would be. The file "deviantart/user/image.jpg" is kept
+// in "deviantart/user.cbz".
+//
+// Entries are numbered in the order they're added, so readers
+// show pages in download order, and a metadata entry describes
+// the archive. Archives of previous runs are appended to by
+// copying their compressed entries as they are into a new
+// archive, which replaces the old one when the storage is closed.
+type ArchiveStorage struct {
+	root     string
+	format   string
+	archives map[string]*zipArchive
+	lock     *sync.Mutex // pointer to avoid copy
+}
+
+// NewArchiveStorage creates a storage of "cbz" or "zip" archives
+// in the given directory.
+func NewArchiveStorage(root string, format string) (*ArchiveStorage, error) {
+	format = strings.ToLower(format)
+	if format != "cbz" && format != "zip" {
+		return nil, fmt.Errorf("unsupported archive format '%s', expected cbz or zip", format)
+	}
+
+	return &ArchiveStorage{
+		root:     root,
+		format:   format,
+		archives: make(map[string]*zipArchive),
+		lock:     &sync.Mutex{},
+	}, nil
+}
+
+// Put adds the file to its folder's archive.
+func (s *ArchiveStorage) Put(key string, r io.Reader, modTime time.Time) error {
+	return s.PutAsset(key, r, modTime, nil)
+}
+
+// PutAsset adds the file to its folder's archive, and describes
+// the asset in the archive's metadata. Replaces an entry with the
+// same filename.
+func (s *ArchiveStorage) PutAsset(key string, r io.Reader, modTime time.Time, asset *Asset) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, name, err := s.open(key)
+	if err != nil {
+		return err
+	}
+
+	if err := a.start(); err != nil {
+		return err
+	}
+
+	if i, ok := a.byName[name]; ok {
+		a.remove(i)
+	}
+
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	// Images are compressed already
+	entry := archiveEntry{
+		name:    fmt.Sprintf("%04d_%s", a.next, name),
+		modTime: modTime,
+		written: true,
+	}
+
+	w, err := a.w.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store, Modified: modTime})
+	if err != nil {
+		return err
+	}
+
+	entry.size, err = io.Copy(w, r)
+	if err != nil {
+		// The partial entry is dropped when the archive is finished
+		entry.removed = true
+		a.dirty = true
+	}
+
+	if asset != nil {
+		a.info.describe(asset, len(a.byName) == 0)
+		entry.page = comicPage{
+			ImageWidth:  asset.Width,
+			ImageHeight: asset.Height,
+			Title:       asset.Title,
+			URL:         asset.URL,
+		}
+	}
+
+	a.add(entry)
+
+	return err
+}
+
+// Open reads an entry as it was in the archive at the start of
+// the run. Entries added during the run can be read once the
+// storage is closed.
+func (s *ArchiveStorage) Open(key string) (io.ReadCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, name, err := s.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	i, ok := a.byName[name]
+	if !ok {
+		return nil, ErrNotExist
+	}
+
+	r, err := zip.OpenReader(a.fp)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range r.File {
+		if f.Name != a.entries[i].name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return &zipEntryReader{ReadCloser: rc, archive: r}, nil
+	}
+
+	r.Close()
+	return nil, ErrNotExist
+}
+
+// zipEntryReader closes the archive along with the entry.
+type zipEntryReader struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (r *zipEntryReader) Close() error {
+	err := r.ReadCloser.Close()
+	if cerr := r.archive.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Exists checks whether the folder's archive has the file.
+func (s *ArchiveStorage) Exists(key string) (bool, error) {
+	_, err := s.Stat(key)
+	if err == ErrNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the size and modification time of the entry.
+func (s *ArchiveStorage) Stat(key string) (ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, name, err := s.open(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	i, ok := a.byName[name]
+	if !ok {
+		return ObjectInfo{}, ErrNotExist
+	}
+
+	return ObjectInfo{Key: key, Size: a.entries[i].size, ModTime: a.entries[i].modTime}, nil
+}
+
+// List returns the entries of all archives, keyed as if they
+// were files in folders.
+func (s *ArchiveStorage) List(prefix string) ([]ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ext := "." + s.format
+
+	err := WalkArchive(s.root, func(fp string, info os.FileInfo) error {
+		if strings.ToLower(filepath.Ext(fp)) != ext {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, fp)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.openArchive(filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	result := make([]ObjectInfo, 0)
+	for akey, a := range s.archives {
+		folder := strings.TrimSuffix(akey, ext)
+
+		for name, i := range a.byName {
+			key := JoinKey(folder, name)
+			if strings.HasPrefix(key, prefix) {
+				result = append(result, ObjectInfo{Key: key, Size: a.entries[i].size, ModTime: a.entries[i].modTime})
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result, nil
+}
+
+// Delete removes the entry from its folder's archive.
+func (s *ArchiveStorage) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, name, err := s.open(key)
+	if err != nil {
+		return err
+	}
+
+	i, ok := a.byName[name]
+	if !ok {
+		return nil
+	}
+
+	a.remove(i)
+
+	return a.start()
+}
+
+// Close finishes the archives that were changed, replacing the
+// archives of previous runs.
+func (s *ArchiveStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var result error
+	for _, a := range s.archives {
+		if err := a.finish(s.format); err != nil && result == nil {
+			result = fmt.Errorf("failed to write archive '%s': %s", a.key, err)
+		}
+	}
+
+	s.archives = make(map[string]*zipArchive)
+
+	return result
+}
+
+// open loads the archive the key belongs in. Returns the archive
+// and the filename of the key.
+func (s *ArchiveStorage) open(key string) (*zipArchive, string, error) {
+	folder, name := path.Split(key)
+
+	a, err := s.openArchive(strings.TrimSuffix(folder, "/") + "." + s.format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return a, name, nil
+}
+
+// openArchive loads the archive with the given key.
+func (s *ArchiveStorage) openArchive(akey string) (*zipArchive, error) {
+	if a, ok := s.archives[akey]; ok {
+		return a, nil
+	}
+
+	a, err := loadZipArchive(akey, filepath.Join(s.root, filepath.FromSlash(akey)), s.format)
+	if err != nil {
+		return nil, err
+	}
+	s.archives[akey] = a
+
+	return a, nil
+}
+
+// zipArchive tracks the entries of an archive during a run.
+type zipArchive struct {
+	key string
+	fp  string
+
+	// entries in archive order, including removed ones
+	entries []archiveEntry
+
+	// byName indexes live entries by their filename,
+	// without the sequence number
+	byName map[string]int
+
+	// next is the sequence number of the next entry
+	next int
+
+	info comicInfo
+
+	// tmp and w are set while the archive is being rewritten
+	tmp *os.File
+	w   *zip.Writer
+
+	// dirty is set when an entry was removed after being written
+	// to the new archive, which then has to be compacted.
+	dirty bool
+}
+
+type archiveEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	page    comicPage
+	removed bool
+	written bool
+}
+
+// loadZipArchive reads the entries and metadata of an existing
+// archive. A missing archive is empty.
+func loadZipArchive(key string, fp string, format string) (*zipArchive, error) {
+	a := &zipArchive{
+		key:    key,
+		fp:     fp,
+		byName: make(map[string]int),
+		next:   1,
+	}
+
+	r, err := zip.OpenReader(fp)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive '%s': %s", fp, err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name == infoFilename(format) {
+			if err := a.info.read(f, format); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		a.add(archiveEntry{name: f.Name, size: int64(f.UncompressedSize64), modTime: f.Modified})
+	}
+
+	// Pages are rebuilt from the entries when the archive is finished
+	for i, page := range a.info.Pages {
+		if page.File != "" {
+			if j, ok := a.byName[page.File]; ok {
+				a.entries[j].page = page
+			}
+		} else if i < len(a.entries) {
+			a.entries[i].page = page
+		}
+	}
+	a.info.Pages = nil
+
+	return a, nil
+}
+
+// add appends an entry, keeping track of the sequence numbers.
+func (a *zipArchive) add(entry archiveEntry) {
+	name := entry.name
+	if m := entryPrefix.FindStringSubmatch(name); m != nil {
+		name = strings.TrimPrefix(name, m[0])
+		if n, err := strconv.Atoi(m[1]); err == nil && n >= a.next {
+			a.next = n + 1
+		}
+	}
+
+	a.entries = append(a.entries, entry)
+	if !entry.removed {
+		a.byName[name] = len(a.entries) - 1
+	}
+}
+
+// remove drops an entry from the archive.
+func (a *zipArchive) remove(i int) {
+	entry := &a.entries[i]
+	entry.removed = true
+
+	for name, j := range a.byName {
+		if j == i {
+			delete(a.byName, name)
+		}
+	}
+
+	if entry.written {
+		a.dirty = true
+	}
+}
+
+// start begins writing a new archive, copying the entries of the
+// existing archive without recompressing them.
+func (a *zipArchive) start() error {
+	if a.w != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.fp), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(filepath.Join(filepath.Dir(a.fp), TempFilename(filepath.Base(a.fp))))
+	if err != nil {
+		return err
+	}
+
+	a.tmp = tmp
+	a.w = zip.NewWriter(tmp)
+
+	return a.copyEntries(a.fp)
+}
+
+// copyEntries copies the live entries of an archive into the new
+// archive.
+func (a *zipArchive) copyEntries(fp string) error {
+	r, err := zip.OpenReader(fp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	live := make(map[string]*archiveEntry)
+	for i := range a.entries {
+		if !a.entries[i].removed {
+			live[a.entries[i].name] = &a.entries[i]
+		}
+	}
+
+	for _, f := range r.File {
+		entry, ok := live[f.Name]
+		if !ok {
+			continue
+		}
+
+		if err := a.w.Copy(f); err != nil {
+			return err
+		}
+		entry.written = true
+	}
+
+	return nil
+}
+
+// finish writes the metadata and replaces the archive with the
+// new one. Does nothing if the archive wasn't changed.
+func (a *zipArchive) finish(format string) error {
+	if a.w == nil {
+		return nil
+	}
+
+	tfp := a.tmp.Name()
+	defer os.Remove(tfp)
+
+	if a.dirty {
+		if err := a.compact(); err != nil {
+			return err
+		}
+	}
+
+	if len(a.byName) == 0 {
+		_ = a.w.Close()
+		_ = a.tmp.Close()
+		_ = os.Remove(a.tmp.Name())
+		return removeIfExists(a.fp)
+	}
+
+	if err := a.writeInfo(format); err != nil {
+		return err
+	}
+
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+
+	// Close file before rename, because Windows locks
+	// the file handle.
+	if err := a.tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(a.tmp.Name(), a.fp)
+}
+
+// compact rewrites the new archive without the entries that were
+// removed after being written to it.
+func (a *zipArchive) compact() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	if err := a.tmp.Close(); err != nil {
+		return err
+	}
+
+	written := a.tmp.Name()
+	defer os.Remove(written)
+
+	tmp, err := os.Create(filepath.Join(filepath.Dir(a.fp), TempFilename(filepath.Base(a.fp)+".compact")))
+	if err != nil {
+		return err
+	}
+
+	a.tmp = tmp
+	a.w = zip.NewWriter(tmp)
+	a.dirty = false
+
+	return a.copyEntries(written)
+}
+
+// writeInfo adds the metadata entry describing the pages.
+func (a *zipArchive) writeInfo(format string) error {
+	info := a.info
+	info.Pages = make([]comicPage, 0, len(a.byName))
+
+	for _, entry := range a.entries {
+		if entry.removed {
+			continue
+		}
+
+		page := entry.page
+		page.Image = len(info.Pages)
+		page.ImageSize = entry.size
+		page.File = entryPrefix.ReplaceAllString(entry.name, "")
+		info.Pages = append(info.Pages, page)
+	}
+	info.PageCount = len(info.Pages)
+
+	if info.Title == "" {
+		info.Title = info.Series
+	}
+
+	var data []byte
+	var err error
+	if format == "cbz" {
+		data, err = xml.MarshalIndent(info, "", "  ")
+		data = append([]byte(xml.Header), data...)
+	} else {
+		data, err = json.MarshalIndent(info, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := a.w.CreateHeader(&zip.FileHeader{Name: infoFilename(format), Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func infoFilename(format string) string {
+	if format == "cbz" {
+		return ComicInfoFilename
+	}
+	return ArchiveInfoFilename
+}
+
+func removeIfExists(fp string) error {
+	err := os.Remove(fp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// comicInfo is the metadata of an archive, following the
+// ComicInfo.xml schema used by comic readers.
+type comicInfo struct {
+	XMLName   xml.Name    `xml:"ComicInfo" json:"-"`
+	Title     string      `xml:"Title,omitempty" json:"title,omitempty"`
+	Series    string      `xml:"Series,omitempty" json:"series,omitempty"`
+	Web       string      `xml:"Web,omitempty" json:"web,omitempty"`
+	Year      int         `xml:"Year,omitempty" json:"year,omitempty"`
+	Month     int         `xml:"Month,omitempty" json:"month,omitempty"`
+	Day       int         `xml:"Day,omitempty" json:"day,omitempty"`
+	Penciller string      `xml:"Penciller,omitempty" json:"artist,omitempty"`
+	PageCount int         `xml:"PageCount" json:"page_count"`
+	Pages     []comicPage `xml:"Pages>Page" json:"pages"`
+}
+
+type comicPage struct {
+	Image       int    `xml:"Image,attr" json:"image"`
+	ImageSize   int64  `xml:"ImageSize,attr,omitempty" json:"size,omitempty"`
+	ImageWidth  int    `xml:"ImageWidth,attr,omitempty" json:"width,omitempty"`
+	ImageHeight int    `xml:"ImageHeight,attr,omitempty" json:"height,omitempty"`
+	File        string `xml:"-" json:"file"`
+	Title       string `xml:"-" json:"title,omitempty"`
+	URL         string `xml:"-" json:"url,omitempty"`
+}
+
+// read decodes the metadata entry of an existing archive.
+func (info *comicInfo) read(f *zip.File, format string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if format == "cbz" {
+		err = xml.NewDecoder(r).Decode(info)
+	} else {
+		err = json.NewDecoder(r).Decode(info)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode '%s': %s", f.Name, err)
+	}
+
+	return nil
+}
+
+// describe merges the asset into the metadata. Fields the pages
+// don't have in common, such as titles of gallery images, are
+// left empty.
+func (info *comicInfo) describe(asset *Asset, first bool) {
+	merge := func(field *string, value string) {
+		if first {
+			*field = value
+		} else if *field != value {
+			*field = ""
+		}
+	}
+
+	merge(&info.Title, asset.Title)
+	merge(&info.Web, asset.PageURL)
+	info.Series = asset.User
+	info.Penciller = asset.User
+
+	if p := asset.Published; !p.IsZero() {
+		latest := time.Date(info.Year, time.Month(info.Month), info.Day, 0, 0, 0, 0, time.UTC)
+		if p.After(latest) {
+			info.Year, info.Month, info.Day = p.Year(), int(p.Month()), p.Day()
+		}
+	}
+}
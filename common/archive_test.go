@@ -0,0 +1,95 @@
+package common
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveStorageAppend(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	put := func(names ...string) {
+		storage, err := NewArchiveStorage(dir, "cbz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			asset := Asset{URL: "https://example.com/" + name, User: "one", Title: "Project"}
+			if err := storage.PutAsset("artstation/one/project/"+name, strings.NewReader(name), time.Time{}, &asset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Act
+	put("b.jpg", "a.jpg")
+	put("c.jpg")
+
+	// Assert
+	r, err := zip.OpenReader(filepath.Join(dir, "artstation", "one", "project.cbz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	expected := []string{"0001_b.jpg", "0002_a.jpg", "0003_c.jpg", ComicInfoFilename}
+	if len(r.File) != len(expected) {
+		t.Fatalf("Expected %d, actual %d", len(expected), len(r.File))
+	}
+	for i, f := range r.File {
+		if f.Name != expected[i] {
+			t.Fatalf("Expected %s, actual %s", expected[i], f.Name)
+		}
+	}
+
+	info := comicInfo{}
+	f, _ := r.File[3].Open()
+	defer f.Close()
+	if err := xml.NewDecoder(f).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.PageCount != 3 {
+		t.Fatalf("Expected %d, actual %d", 3, info.PageCount)
+	}
+	if info.Title != "Project" {
+		t.Fatalf("Expected %s, actual %s", "Project", info.Title)
+	}
+}
+
+func TestArchiveStorageDelete(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	storage, err := NewArchiveStorage(dir, "zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := storage.Put("deviantart/one/"+name, strings.NewReader(name), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Act
+	if err := storage.Delete("deviantart/one/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	list, err := storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Key != "deviantart/one/b.jpg" {
+		t.Fatalf("Expected only 'deviantart/one/b.jpg', actual %+v", list)
+	}
+}
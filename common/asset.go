@@ -0,0 +1,145 @@
+package common
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Asset describes a single file discovered by a scraper, along
+// with whatever is known about it before it is downloaded.
+//
+// Fields that the source did not provide are left as zero
+// values, and may be filled in as the download progresses.
+type Asset struct {
+	// URL is the location the file is downloaded from
+	URL string
+
+	// Site and User identify the gallery the asset belongs to
+	Site string
+	User string
+
+	// ArtworkID identifies the artwork the asset is part of
+	// on the site
+	ArtworkID string
+
+	// Index is the position of the asset within its artwork,
+	// starting at 1
+	Index int
+
+	// Title of the artwork the asset is part of
+	Title string
+
+	// Description the artist gave the artwork, as provided by
+	// the site, which may be HTML
+	Description string
+
+	// Tags the artist gave the artwork
+	Tags []string
+
+	// PageURL is the artwork's page on the site
+	PageURL string
+
+	// Width and Height are the image dimensions in pixels
+	Width  int
+	Height int
+
+	// Size is the file size in bytes
+	Size int64
+
+	// ContentType is the MIME type of the file
+	ContentType string
+
+	// Published is when the artwork was published on the site
+	Published time.Time
+
+	// Headers are added to the requests for the file, eg. a
+	// Referer the site's CDN expects.
+	Headers http.Header
+
+	// Source is the raw metadata the site gave for the artwork,
+	// as JSON, eg. an RSS item or an API response.
+	Source json.RawMessage
+}
+
+// contentTypeExtensions maps MIME types to the file
+// extension we consider canonical for it.
+var contentTypeExtensions = map[string]string{
+	"image/jpeg":    "jpg",
+	"image/png":     "png",
+	"image/gif":     "gif",
+	"image/webp":    "webp",
+	"image/bmp":     "bmp",
+	"image/svg+xml": "svg",
+	"video/mp4":     "mp4",
+	"video/webm":    "webm",
+}
+
+// Filename returns the name of the file in the URL.
+func (a *Asset) Filename() string {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return ""
+	}
+
+	return path.Base(u.Path)
+}
+
+// Type returns the normalised file type of the asset, as a
+// lower case extension without the leading period.
+//
+// The content type takes priority when known, otherwise the
+// extension in the URL is used. Returns an empty string when
+// the type can't be determined.
+func (a *Asset) Type() string {
+	if t := typeFromContentType(a.ContentType); t != "" {
+		return t
+	}
+
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return ""
+	}
+
+	return NormalizeType(path.Ext(u.Path))
+}
+
+// NormalizeType converts a file extension or type name into
+// the form used to compare types, for example ".JPEG" to "jpg".
+func NormalizeType(ext string) string {
+	t := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+	switch t {
+	case "jpeg", "jpe":
+		return "jpg"
+	case "tif":
+		return "tiff"
+	}
+	return t
+}
+
+// typeFromContentType maps a MIME type to a file type, ignoring
+// generic types that say nothing about the content.
+func typeFromContentType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+
+	if t, ok := contentTypeExtensions[mediaType]; ok {
+		return t
+	}
+
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return NormalizeType(exts[0])
+	}
+
+	return ""
+}
@@ -0,0 +1,575 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CatalogFilename is the name of the catalog database created in
+// the root of the output directory.
+const CatalogFilename string = ".art-dl-catalog.db"
+
+// ErrCatalogInUse is returned when the catalog can't be read,
+// because a download is writing to it.
+var ErrCatalogInUse = errors.New("catalog is in use by a running download")
+
+var (
+	artistsBucket  = []byte("artists")
+	artworksBucket = []byte("artworks")
+	assetsBucket   = []byte("assets")
+	pathsBucket    = []byte("paths")
+	tagsBucket     = []byte("tags")
+)
+
+// ArtistRecord is a gallery in the catalog.
+type ArtistRecord struct {
+	Site      string    `json:"site"`
+	User      string    `json:"user"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ArtworkRecord is an artwork in the catalog, with the metadata
+// the site gave for it.
+type ArtworkRecord struct {
+	Site        string          `json:"site"`
+	User        string          `json:"user"`
+	ID          string          `json:"id,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Description string          `json:"description,omitempty"`
+	PageURL     string          `json:"page_url,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Published   time.Time       `json:"published"`
+	Source      json.RawMessage `json:"source,omitempty"`
+	FirstSeen   time.Time       `json:"first_seen"`
+	LastSeen    time.Time       `json:"last_seen"`
+}
+
+// Key identifies the artwork in the catalog.
+func (r *ArtworkRecord) Key() string {
+	id := r.ID
+	if id == "" {
+		id = r.PageURL
+	}
+	return r.Site + "/" + r.User + "/" + id
+}
+
+// AssetRecord is a file of an artwork in the catalog. Path, Size
+// and SHA256 are empty until the file is stored.
+type AssetRecord struct {
+	URL         string    `json:"url"`
+	Artwork     string    `json:"artwork"`
+	Index       int       `json:"index,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Stored      time.Time `json:"stored"`
+}
+
+// Catalog is a database of the artists, artworks and files seen
+// by scrapers, kept in the output directory across runs.
+//
+// Scrapers record assets as they discover them, whether they are
+// downloaded or not, so the catalog also knows when each was
+// first and last seen upstream.
+//
+// A nil catalog records nothing and finds nothing, for runs that
+// leave nothing on disk.
+type Catalog struct {
+	db *bolt.DB
+}
+
+// OpenCatalog opens the catalog of the output directory, creating
+// it if it doesn't exist yet.
+func OpenCatalog(directory string) (*Catalog, error) {
+	fp := filepath.Join(directory, CatalogFilename)
+
+	db, err := bolt.Open(fp, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog '%s': %s", fp, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{artistsBucket, artworksBucket, assetsBucket, pathsBucket, tagsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open catalog '%s': %s", fp, err)
+	}
+
+	return &Catalog{db: db}, nil
+}
+
+// OpenCatalogReadOnly opens the catalog of the output directory
+// for reading only. Returns `ErrNotExist` if there is none.
+//
+// Downloads hold the catalog for the whole run, during which it
+// can't be read. Returns `ErrCatalogInUse` then.
+func OpenCatalogReadOnly(directory string) (*Catalog, error) {
+	fp := filepath.Join(directory, CatalogFilename)
+
+	if _, err := os.Stat(fp); os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+
+	db, err := bolt.Open(fp, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, ErrCatalogInUse
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog '%s': %s", fp, err)
+	}
+
+	return &Catalog{db: db}, nil
+}
+
+// Close closes the database.
+func (c *Catalog) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// Seen records an asset found by a scraper, along with its artist
+// and artwork, updating when they were last seen.
+func (c *Catalog) Seen(asset *Asset) error {
+	if c == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	// Scrapers discover assets concurrently, so their
+	// writes are batched into fewer transactions.
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		artist := ArtistRecord{Site: asset.Site, User: asset.User}
+		artistKey := []byte(asset.Site + "/" + asset.User)
+		if _, err := getRecord(tx.Bucket(artistsBucket), artistKey, &artist); err != nil {
+			return err
+		}
+		artist.LastSeen = now
+		if artist.FirstSeen.IsZero() {
+			artist.FirstSeen = now
+		}
+		if err := putRecord(tx.Bucket(artistsBucket), artistKey, &artist); err != nil {
+			return err
+		}
+
+		artwork := ArtworkRecord{Site: asset.Site, User: asset.User, ID: asset.ArtworkID, PageURL: asset.PageURL}
+		if artwork.ID == "" && artwork.PageURL == "" {
+			// Artworks of one file are known by it
+			artwork.PageURL = asset.URL
+		}
+		artworkKey := []byte(artwork.Key())
+		if _, err := getRecord(tx.Bucket(artworksBucket), artworkKey, &artwork); err != nil {
+			return err
+		}
+
+		// Scrapers give the same metadata with each asset of an
+		// artwork, so assets without it leave the artwork be.
+		if asset.Tags != nil {
+			for _, tag := range artwork.Tags {
+				if err := tx.Bucket(tagsBucket).Delete(tagKey(tag, artwork.Key())); err != nil {
+					return err
+				}
+			}
+			for _, tag := range asset.Tags {
+				if err := tx.Bucket(tagsBucket).Put(tagKey(tag, artwork.Key()), nil); err != nil {
+					return err
+				}
+			}
+			artwork.Tags = asset.Tags
+		}
+		if asset.Title != "" {
+			artwork.Title = asset.Title
+		}
+		if asset.Description != "" {
+			artwork.Description = asset.Description
+		}
+		if !asset.Published.IsZero() {
+			artwork.Published = asset.Published
+		}
+		if asset.PageURL != "" {
+			artwork.PageURL = asset.PageURL
+		}
+		if len(asset.Source) > 0 {
+			artwork.Source = asset.Source
+		}
+		artwork.LastSeen = now
+		if artwork.FirstSeen.IsZero() {
+			artwork.FirstSeen = now
+		}
+		if err := putRecord(tx.Bucket(artworksBucket), artworkKey, &artwork); err != nil {
+			return err
+		}
+
+		record := AssetRecord{URL: asset.URL}
+		if _, err := getRecord(tx.Bucket(assetsBucket), []byte(asset.URL), &record); err != nil {
+			return err
+		}
+		record.Artwork = artwork.Key()
+		record.Index = asset.Index
+		if asset.Width > 0 && asset.Height > 0 {
+			record.Width, record.Height = asset.Width, asset.Height
+		}
+		if asset.ContentType != "" {
+			record.ContentType = asset.ContentType
+		}
+		record.LastSeen = now
+		if record.FirstSeen.IsZero() {
+			record.FirstSeen = now
+		}
+
+		return putRecord(tx.Bucket(assetsBucket), []byte(asset.URL), &record)
+	})
+}
+
+// Stored records where an asset's file was stored, and its
+// size and content hash.
+func (c *Catalog) Stored(url string, key string, size int64, hash string) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		assets := tx.Bucket(assetsBucket)
+
+		record := AssetRecord{URL: url, FirstSeen: time.Now(), LastSeen: time.Now()}
+		if _, err := getRecord(assets, []byte(url), &record); err != nil {
+			return err
+		}
+
+		if record.Path != "" && record.Path != key {
+			if err := tx.Bucket(pathsBucket).Delete([]byte(record.Path)); err != nil {
+				return err
+			}
+		}
+
+		record.Path = key
+		record.Size = size
+		record.SHA256 = hash
+		record.Stored = time.Now()
+
+		if err := tx.Bucket(pathsBucket).Put([]byte(key), []byte(url)); err != nil {
+			return err
+		}
+
+		return putRecord(assets, []byte(url), &record)
+	})
+}
+
+// Removed forgets where an asset's file was stored, when the file
+// is gone. The asset itself stays in the catalog.
+func (c *Catalog) Removed(key string) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		paths := tx.Bucket(pathsBucket)
+
+		url := paths.Get([]byte(key))
+		if url == nil {
+			return nil
+		}
+		url = append([]byte{}, url...)
+
+		if err := paths.Delete([]byte(key)); err != nil {
+			return err
+		}
+
+		var record AssetRecord
+		if ok, err := getRecord(tx.Bucket(assetsBucket), url, &record); err != nil || !ok {
+			return err
+		}
+		record.Path, record.Size, record.SHA256 = "", 0, ""
+		record.Stored = time.Time{}
+
+		return putRecord(tx.Bucket(assetsBucket), url, &record)
+	})
+}
+
+// Moved records that stored files were moved, given as a map of
+// old paths to new ones. All paths are updated together, or none
+// are. Paths the catalog doesn't know are ignored.
+func (c *Catalog) Moved(paths map[string]string) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pathsBucket)
+
+		for from, to := range paths {
+			url := bucket.Get([]byte(from))
+			if url == nil {
+				continue
+			}
+			url = append([]byte{}, url...)
+
+			if err := bucket.Delete([]byte(from)); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(to), url); err != nil {
+				return err
+			}
+
+			var record AssetRecord
+			ok, err := getRecord(tx.Bucket(assetsBucket), url, &record)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			record.Path = to
+
+			if err := putRecord(tx.Bucket(assetsBucket), url, &record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FindURL returns the asset downloaded from the URL.
+func (c *Catalog) FindURL(url string) (AssetRecord, bool) {
+	var record AssetRecord
+	if c == nil {
+		return record, false
+	}
+
+	var ok bool
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = getRecord(tx.Bucket(assetsBucket), []byte(url), &record)
+		return err
+	})
+
+	return record, ok
+}
+
+// FindPath returns the asset stored under the key.
+func (c *Catalog) FindPath(key string) (AssetRecord, bool) {
+	var record AssetRecord
+	if c == nil {
+		return record, false
+	}
+
+	var ok bool
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		url := tx.Bucket(pathsBucket).Get([]byte(key))
+		if url == nil {
+			return nil
+		}
+		var err error
+		ok, err = getRecord(tx.Bucket(assetsBucket), url, &record)
+		return err
+	})
+
+	return record, ok
+}
+
+// Artwork returns the artwork with the given key.
+func (c *Catalog) Artwork(key string) (ArtworkRecord, bool) {
+	var record ArtworkRecord
+	if c == nil {
+		return record, false
+	}
+
+	var ok bool
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = getRecord(tx.Bucket(artworksBucket), []byte(key), &record)
+		return err
+	})
+
+	return record, ok
+}
+
+// Artists returns all artists, ordered by site and user.
+func (c *Catalog) Artists() ([]ArtistRecord, error) {
+	result := make([]ArtistRecord, 0)
+	if c == nil {
+		return result, nil
+	}
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(artistsBucket).ForEach(func(k, v []byte) error {
+			var record ArtistRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			result = append(result, record)
+			return nil
+		})
+	})
+
+	return result, err
+}
+
+// ForEachArtwork calls the function with each artwork and its
+// assets, ordered by artwork key and then by index.
+func (c *Catalog) ForEachArtwork(fn func(artwork ArtworkRecord, assets []AssetRecord) error) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.db.View(func(tx *bolt.Tx) error {
+		assets, err := c.assetsByArtwork(tx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(artworksBucket).ForEach(func(k, v []byte) error {
+			var record ArtworkRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			return fn(record, assets[string(k)])
+		})
+	})
+}
+
+// Assets returns all assets, ordered by URL.
+func (c *Catalog) Assets() ([]AssetRecord, error) {
+	result := make([]AssetRecord, 0)
+	if c == nil {
+		return result, nil
+	}
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(assetsBucket).ForEach(func(k, v []byte) error {
+			var record AssetRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			result = append(result, record)
+			return nil
+		})
+	})
+
+	return result, err
+}
+
+// Tagged returns the keys of the artworks with the tag.
+func (c *Catalog) Tagged(tag string) ([]string, error) {
+	result := make([]string, 0)
+	if c == nil {
+		return result, nil
+	}
+
+	prefix := tagKey(tag, "")
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(tagsBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			result = append(result, string(k[len(prefix):]))
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (c *Catalog) assetsByArtwork(tx *bolt.Tx) (map[string][]AssetRecord, error) {
+	result := make(map[string][]AssetRecord)
+
+	err := tx.Bucket(assetsBucket).ForEach(func(k, v []byte) error {
+		var record AssetRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		result[record.Artwork] = append(result[record.Artwork], record)
+		return nil
+	})
+
+	for _, assets := range result {
+		sort.Slice(assets, func(i, j int) bool {
+			if assets[i].Index != assets[j].Index {
+				return assets[i].Index < assets[j].Index
+			}
+			return assets[i].URL < assets[j].URL
+		})
+	}
+
+	return result, err
+}
+
+// tagKey indexes an artwork by a tag. Tags are matched case
+// insensitively.
+func tagKey(tag string, artworkKey string) []byte {
+	return []byte(strings.ToLower(strings.TrimSpace(tag)) + "\x00" + artworkKey)
+}
+
+// getRecord decodes the record under the key, if there is one.
+func getRecord(bucket *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := bucket.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("corrupt catalog record '%s': %s", key, err)
+	}
+	return true, nil
+}
+
+func putRecord(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// HashFile returns the hexadecimal SHA-256 of a stored file.
+func HashFile(storage ReadableStorage, key string) (string, error) {
+	r, err := storage.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashLocalFile writes the content of a local file to the hash.
+func hashLocalFile(h hash.Hash, fp string) error {
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(h, file)
+	return err
+}
@@ -0,0 +1,209 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets := []Asset{
+		{URL: "https://example.com/a.jpg", Site: "artstation", User: "one", ArtworkID: "42", Index: 1, Title: "Dragon", Tags: []string{"Concept"}},
+		{URL: "https://example.com/b.jpg", Site: "artstation", User: "one", ArtworkID: "42", Index: 2, Title: "Dragon", Tags: []string{"Concept"}},
+	}
+
+	// Act
+	for i := range assets {
+		if err := catalog.Seen(&assets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := catalog.Stored(assets[0].URL, "artstation/one/a.jpg", 4, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err = OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+
+	// Assert
+	record, ok := catalog.FindPath("artstation/one/a.jpg")
+	if !ok || record.URL != assets[0].URL || record.SHA256 != "abcd" {
+		t.Fatalf("Expected stored asset, actual %+v", record)
+	}
+
+	artwork, ok := catalog.Artwork(record.Artwork)
+	if !ok || artwork.Title != "Dragon" || artwork.FirstSeen.IsZero() {
+		t.Fatalf("Expected artwork, actual %+v", artwork)
+	}
+
+	tagged, err := catalog.Tagged("concept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 1 || tagged[0] != artwork.Key() {
+		t.Fatalf("Expected %v, actual %v", []string{artwork.Key()}, tagged)
+	}
+}
+
+func TestCatalogRemoved(t *testing.T) {
+	// Arrange
+	catalog, err := OpenCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	asset := Asset{URL: "https://example.com/a.jpg", Site: "deviantart", User: "one"}
+	if err := catalog.Seen(&asset); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.Stored(asset.URL, "deviantart/one/a.jpg", 4, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	err = catalog.Removed("deviantart/one/a.jpg")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := catalog.FindPath("deviantart/one/a.jpg"); ok {
+		t.Fatalf("Expected path to be forgotten")
+	}
+	if record, ok := catalog.FindURL(asset.URL); !ok || record.Path != "" {
+		t.Fatalf("Expected asset without path, actual %+v", record)
+	}
+}
+
+func TestCatalogMoved(t *testing.T) {
+	// Arrange
+	catalog, err := OpenCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	asset := Asset{URL: "https://example.com/a.jpg", Site: "deviantart", User: "one"}
+	if err := catalog.Seen(&asset); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.Stored(asset.URL, "deviantart/one/a.jpg", 4, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	err = catalog.Moved(map[string]string{"deviantart/one/a.jpg": "deviantart/one/2019/a.jpg"})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := catalog.FindPath("deviantart/one/a.jpg"); ok {
+		t.Fatalf("Expected old path to be forgotten")
+	}
+	if record, ok := catalog.FindPath("deviantart/one/2019/a.jpg"); !ok || record.SHA256 != "abcd" {
+		t.Fatalf("Expected asset at new path, actual %+v", record)
+	}
+}
+
+func TestSessionRecordsCatalog(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	session, err := NewSession(&Config{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := Asset{URL: server.URL + "/a.jpg", Site: "deviantart", User: "one", Title: "Dragon"}
+
+	// Act
+	key, err := session.Download(&asset, "{site}/{user}/{filename}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	record, ok := catalog.FindURL(asset.URL)
+	if !ok || record.Path != key {
+		t.Fatalf("Expected asset stored at %s, actual %+v", key, record)
+	}
+	// SHA-256 of "data"
+	expected := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	if record.SHA256 != expected {
+		t.Fatalf("Expected %s, actual %s", expected, record.SHA256)
+	}
+}
+
+func TestSessionRecordsCatalogArchive(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	session, err := NewSession(&Config{Directory: dir, Archive: "cbz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := Asset{URL: server.URL + "/a.jpg", Site: "deviantart", User: "one", Title: "Dragon"}
+
+	// Act
+	if _, err := session.Download(&asset, "{site}/{user}/{filename}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	record, _ := catalog.FindURL(asset.URL)
+	// SHA-256 of "data"
+	expected := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	if record.SHA256 != expected {
+		t.Fatalf("Expected %s, actual %s", expected, record.SHA256)
+	}
+}
+
+func TestCatalogReadOnlyInUse(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+
+	// Act
+	_, err = OpenCatalogReadOnly(dir)
+
+	// Assert
+	if err != ErrCatalogInUse {
+		t.Fatalf("Expected %v, actual %v", ErrCatalogInUse, err)
+	}
+}
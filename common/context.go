@@ -1,5 +1,13 @@
 package common
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
 // Config holds the values passed into the application from the command line
 // or from files.
 type Config struct {
@@ -7,4 +15,241 @@ type Config struct {
 	SeedURLs         []string
 	GalleryFile      string
 	ConcurrencyLevel int
+
+	// LockWait is how long to wait for another instance to release
+	// the output directory before giving up.
+	LockWait time.Duration
+
+	// Force downloads assets again even when the manifest
+	// shows they were downloaded by a previous run.
+	Force bool
+
+	// ResumePartial keeps partial downloads left by an interrupted
+	// run so they can be resumed, instead of removing them.
+	ResumePartial bool
+
+	// Filter rejects unwanted assets before they are downloaded.
+	Filter Filter
+
+	// MinFreeSpace is the free disk space in bytes below which
+	// downloads stop, or pause if PauseOnLowSpace is set.
+	MinFreeSpace    int64
+	PauseOnLowSpace bool
+
+	// GalleryQuota is the default maximum number of bytes
+	// downloaded per gallery. Zero is unlimited.
+	GalleryQuota int64
+
+	// Proxy is the URL of the proxy all requests are sent through.
+	// See `NewHTTPClient`.
+	Proxy string
+
+	// UserAgent is sent with every request, unless a site
+	// overrides it.
+	UserAgent string
+
+	// Template lays out downloaded files, for sites that don't
+	// set their own. Empty uses each site's default layout. See
+	// `PathTemplate`.
+	Template string
+
+	// Storage selects where downloaded files are kept. Empty
+	// keeps them in Directory. See `OpenStorage`.
+	Storage string
+
+	// Archive is "cbz" or "zip" to keep each gallery or project
+	// as a single archive instead of a folder of files.
+	Archive string
+
+	// Tar is where to stream downloaded files as a tar archive,
+	// "-" for standard output, instead of storing them.
+	Tar string
+
+	// Sidecar is "file" or "project" to write the metadata of
+	// downloaded artworks next to their files. See `Sidecar`.
+	Sidecar string
+
+	// Export is a format to list discovered assets in on standard
+	// output, instead of downloading them. See `Exporter`.
+	Export string
+
+	// DryRun lists the assets that would be downloaded, without
+	// downloading them or creating any folders.
+	DryRun bool
+
+	// Mirror removes files whose assets are no longer listed in
+	// their gallery, after it's listed completely. They're moved
+	// to the `.removed` folder, or deleted when Prune is set.
+	Mirror bool
+	Prune  bool
+
+	// MirrorThreshold is the largest share of a gallery's files,
+	// from 0 to 1, that a mirrored run removes. Default is
+	// `DefaultMirrorThreshold`.
+	MirrorThreshold float64
+
+	// Adopt only matches the listed assets to files adopted from
+	// an existing archive, see `AdoptFiles`, without downloading
+	// the rest.
+	Adopt bool
+
+	// URLs limits downloads to the assets with these URLs, when
+	// not empty, eg. to download a few files of their galleries
+	// again. Other assets are skipped.
+	URLs map[string]bool
+
+	// ConfigFile is the path of the file containing per site settings
+	ConfigFile string
+
+	// Processors is the default chain of processors run on
+	// downloaded files, for sites that don't configure their own.
+	Processors []ProcessorConfig
+
+	// Sites holds settings for individual sites, keyed by
+	// the site name used in the rule mappings.
+	Sites map[string]SiteConfig
+}
+
+// SiteConfig holds settings that apply to a single site.
+type SiteConfig struct {
+	// GalleryQuota is the maximum number of bytes downloaded per
+	// gallery on this site. Overrides the global quota.
+	GalleryQuota ByteSize `json:"gallery_quota"`
+
+	// Quota is the maximum number of bytes downloaded for all
+	// galleries on this site.
+	Quota ByteSize `json:"quota"`
+
+	// Processors is the ordered chain of processors run on each
+	// file downloaded from this site. Overrides the default chain.
+	Processors []ProcessorConfig `json:"processors"`
+
+	// Proxy is the URL of the proxy requests to this site are sent
+	// through. Overrides the global proxy. Use "direct" to bypass
+	// the global proxy.
+	Proxy string `json:"proxy"`
+
+	// UserAgent is sent with requests to this site. Overrides
+	// the global user agent.
+	UserAgent string `json:"user_agent"`
+
+	// Headers are added to requests to this site, eg. Referer
+	// or Accept-Language.
+	Headers map[string]string `json:"headers"`
+
+	// Template lays out files downloaded from this site.
+	// Overrides the global template. See `PathTemplate`.
+	Template string `json:"template"`
+}
+
+// Header returns the headers to add to requests to the site,
+// including the user agent.
+func (s *SiteConfig) Header() http.Header {
+	header := make(http.Header)
+
+	for key, value := range s.Headers {
+		header.Set(key, value)
+	}
+
+	if s.UserAgent != "" {
+		header.Set("User-Agent", s.UserAgent)
+	}
+
+	return header
+}
+
+// Site returns the settings for the named site, with global
+// settings filled in where the site doesn't override them.
+func (c *Config) Site(name string) SiteConfig {
+	site := c.Sites[name]
+
+	if site.GalleryQuota == 0 {
+		site.GalleryQuota = ByteSize(c.GalleryQuota)
+	}
+
+	if site.Processors == nil {
+		site.Processors = c.Processors
+	}
+
+	if site.Proxy == "" {
+		site.Proxy = c.Proxy
+	}
+
+	if site.UserAgent == "" {
+		site.UserAgent = c.UserAgent
+	}
+
+	if site.Template == "" {
+		site.Template = c.Template
+	}
+
+	return site
+}
+
+// Redacted returns a copy of the config with credentials in proxy
+// URLs and request headers hidden, so it can be logged.
+func (c Config) Redacted() Config {
+	c.Proxy = redactURL(c.Proxy)
+
+	sites := make(map[string]SiteConfig, len(c.Sites))
+	for name, site := range c.Sites {
+		site.Proxy = redactURL(site.Proxy)
+		site.Headers = redactHeaders(site.Headers)
+		sites[name] = site
+	}
+	c.Sites = sites
+
+	return c
+}
+
+// configFile is the on-disk format of the config file.
+type configFile struct {
+	Processors []ProcessorConfig     `json:"processors"`
+	Sites      map[string]SiteConfig `json:"sites"`
+}
+
+// LoadConfigFile reads per site settings from a JSON file
+// into the config.
+func LoadConfigFile(filepath string, config *Config) error {
+	b, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %s", err)
+	}
+
+	var data configFile
+	if err := json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("failed to parse config file '%s': %s", filepath, err)
+	}
+
+	// Processors given on the command line run first
+	config.Processors = append(config.Processors, data.Processors...)
+	config.Sites = data.Sites
+
+	return nil
+}
+
+// ByteSize is a number of bytes that can be given in
+// config files as a human readable string, eg. "5GB".
+type ByteSize int64
+
+// UnmarshalJSON accepts either a number or a string.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid size %s", data)
+	}
+
+	n, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+
+	return nil
 }
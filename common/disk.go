@@ -0,0 +1,123 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// diskCheckInterval is how many bytes are written between
+	// free space checks while a file is downloading.
+	diskCheckInterval int64 = 16 << 20
+
+	// diskPollInterval is how often a paused run checks whether
+	// space has been freed.
+	diskPollInterval time.Duration = 30 * time.Second
+)
+
+// ErrDiskSpace is returned when the output directory runs low
+// on free space and the run has to stop.
+var ErrDiskSpace = errors.New("insufficient free disk space")
+
+// DiskGuard stops or pauses downloads when the free space in
+// the output directory drops below a threshold.
+type DiskGuard struct {
+	// Directory is checked for free space
+	Directory string
+
+	// MinFree is the number of bytes that must remain free
+	MinFree int64
+
+	// Pause waits for space to be freed, instead of stopping
+	Pause bool
+
+	stopped bool
+	lock    *sync.Mutex // pointer to avoid copy
+}
+
+// NewDiskGuard creates a guard for the directory. A minimum
+// of zero disables the guard.
+func NewDiskGuard(directory string, minFree int64, pause bool) *DiskGuard {
+	return &DiskGuard{
+		Directory: directory,
+		MinFree:   minFree,
+		Pause:     pause,
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Check tests the free space in the directory.
+//
+// When space is low, it either blocks until enough is freed,
+// or returns `ErrDiskSpace`. Once stopped, every following
+// check fails without looking at the disk again.
+func (g *DiskGuard) Check() error {
+	if g == nil || g.MinFree <= 0 {
+		return nil
+	}
+
+	// Serialise checks so a paused run logs once,
+	// and waiting workers resume together.
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.stopped {
+		return ErrDiskSpace
+	}
+
+	logged := false
+	for {
+		free, err := FreeSpace(g.Directory)
+		if err != nil {
+			// Can't tell, so don't get in the way
+			log.Println("Warning: Failed to determine free disk space:", err)
+			return nil
+		}
+
+		if free >= g.MinFree {
+			if logged {
+				log.Println("Free disk space recovered, resuming")
+			}
+			return nil
+		}
+
+		if !g.Pause {
+			g.stopped = true
+			return fmt.Errorf("%w: %s free in '%s', minimum is %s",
+				ErrDiskSpace, FormatByteSize(free), g.Directory, FormatByteSize(g.MinFree))
+		}
+
+		if !logged {
+			log.Printf("Warning: Only %s free in '%s', pausing until %s is available",
+				FormatByteSize(free), g.Directory, FormatByteSize(g.MinFree))
+			logged = true
+		}
+
+		time.Sleep(diskPollInterval)
+	}
+}
+
+// guardedWriter checks the disk guard periodically while
+// a file is being written.
+type guardedWriter struct {
+	w       io.Writer
+	guard   *DiskGuard
+	pending int64
+}
+
+func (gw *guardedWriter) Write(p []byte) (int, error) {
+	if gw.pending >= diskCheckInterval {
+		gw.pending = 0
+		if err := gw.guard.Check(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := gw.w.Write(p)
+	gw.pending += int64(n)
+	return n, err
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to
+// unprivileged users on the file system of the path.
+func FreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	// Field types differ between platforms
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ExportJSONL writes a JSON object per line for each asset.
+	ExportJSONL string = "jsonl"
+
+	// ExportCSV writes a row per asset, after a header row.
+	ExportCSV string = "csv"
+
+	// ExportAria2 writes an aria2c input file, saving each asset
+	// to its path in the output directory.
+	ExportAria2 string = "aria2"
+
+	// ExportWget writes a URL per line, for wget -i.
+	ExportWget string = "wget"
+)
+
+// exportColumns are the header row of CSV exports.
+var exportColumns = []string{
+	"url", "path", "site", "user", "artwork_id", "index", "title", "page_url",
+	"tags", "published", "width", "height", "size", "content_type",
+}
+
+// exportRecord is the JSON Lines format of an exported asset.
+type exportRecord struct {
+	URL         string     `json:"url"`
+	Path        string     `json:"path"`
+	Site        string     `json:"site"`
+	User        string     `json:"user"`
+	ArtworkID   string     `json:"artwork_id,omitempty"`
+	Index       int        `json:"index,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	PageURL     string     `json:"page_url,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Published   *time.Time `json:"published,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+}
+
+// Exporter writes a list of discovered assets, for other tools
+// to download them.
+type Exporter struct {
+	format    string
+	directory string
+	w         *bufio.Writer
+	csv       *csv.Writer
+	lock      *sync.Mutex // pointer to avoid copy
+}
+
+// NewExporter creates an exporter writing in the given format.
+// Paths are the storage keys of the assets, except in aria2
+// input files, which save them under the output directory.
+func NewExporter(format string, directory string, w io.Writer) (*Exporter, error) {
+	e := &Exporter{
+		format:    strings.ToLower(format),
+		directory: directory,
+		w:         bufio.NewWriter(w),
+		lock:      &sync.Mutex{},
+	}
+
+	switch e.format {
+	case ExportJSONL, ExportAria2, ExportWget:
+	case ExportCSV:
+		e.csv = csv.NewWriter(e.w)
+		if err := e.csv.Write(exportColumns); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported export format '%s', expected %s, %s, %s or %s",
+			format, ExportJSONL, ExportCSV, ExportAria2, ExportWget)
+	}
+
+	return e, nil
+}
+
+// Export writes the asset, which would be stored under the key.
+func (e *Exporter) Export(asset *Asset, key string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	switch e.format {
+	case ExportJSONL:
+		record := exportRecord{
+			URL:         asset.URL,
+			Path:        key,
+			Site:        asset.Site,
+			User:        asset.User,
+			ArtworkID:   asset.ArtworkID,
+			Index:       asset.Index,
+			Title:       asset.Title,
+			PageURL:     asset.PageURL,
+			Tags:        asset.Tags,
+			Width:       asset.Width,
+			Height:      asset.Height,
+			Size:        asset.Size,
+			ContentType: asset.ContentType,
+		}
+		if !asset.Published.IsZero() {
+			published := asset.Published
+			record.Published = &published
+		}
+
+		b, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		e.w.Write(b)
+		return e.w.WriteByte('\n')
+
+	case ExportCSV:
+		published := ""
+		if !asset.Published.IsZero() {
+			published = asset.Published.Format(time.RFC3339)
+		}
+
+		return e.csv.Write([]string{
+			asset.URL, key, asset.Site, asset.User, asset.ArtworkID, strconv.Itoa(asset.Index),
+			asset.Title, asset.PageURL, strings.Join(asset.Tags, ";"), published,
+			strconv.Itoa(asset.Width), strconv.Itoa(asset.Height),
+			strconv.FormatInt(asset.Size, 10), asset.ContentType,
+		})
+
+	case ExportAria2:
+		fmt.Fprintln(e.w, asset.URL)
+		fmt.Fprintf(e.w, "  dir=%s\n", filepath.Join(e.directory, filepath.FromSlash(path.Dir(key))))
+		fmt.Fprintf(e.w, "  out=%s\n", path.Base(key))
+
+		// Sites may refuse requests without their headers
+		names := make([]string, 0, len(asset.Headers))
+		for name := range asset.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, value := range asset.Headers[name] {
+				fmt.Fprintf(e.w, "  header=%s: %s\n", name, value)
+			}
+		}
+		return nil
+
+	case ExportWget:
+		_, err := fmt.Fprintln(e.w, asset.URL)
+		return err
+	}
+
+	return nil
+}
+
+// Flush writes out buffered lines.
+func (e *Exporter) Flush() error {
+	if e == nil {
+		return nil
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	return e.w.Flush()
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporter(t *testing.T) {
+	// Arrange
+	asset := Asset{
+		URL:       "https://cdn.example.com/a.jpg",
+		Site:      "artstation",
+		User:      "one",
+		ArtworkID: "42",
+		Index:     1,
+		Title:     "Dragon, red",
+		Tags:      []string{"concept", "dragon"},
+		Published: time.Date(2019, 7, 19, 0, 0, 0, 0, time.UTC),
+		Headers:   http.Header{"Referer": []string{"https://www.artstation.com/"}},
+	}
+	dir := filepath.Join("out", "art")
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{ExportJSONL, `{"url":"https://cdn.example.com/a.jpg","path":"artstation/one/a.jpg","site":"artstation","user":"one","artwork_id":"42","index":1,"title":"Dragon, red","tags":["concept","dragon"],"published":"2019-07-19T00:00:00Z"}` + "\n"},
+		{ExportCSV, strings.Join(exportColumns, ",") + "\n" + `https://cdn.example.com/a.jpg,artstation/one/a.jpg,artstation,one,42,1,"Dragon, red",,concept;dragon,2019-07-19T00:00:00Z,0,0,0,` + "\n"},
+		{ExportAria2, "https://cdn.example.com/a.jpg\n  dir=" + filepath.Join(dir, "artstation", "one") + "\n  out=a.jpg\n  header=Referer: https://www.artstation.com/\n"},
+		{ExportWget, "https://cdn.example.com/a.jpg\n"},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		exporter, err := NewExporter(c.format, dir, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Act
+		if err := exporter.Export(&asset, "artstation/one/a.jpg"); err != nil {
+			t.Fatal(err)
+		}
+		if err := exporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Assert
+		if buf.String() != c.expected {
+			t.Fatalf("Expected %s, actual %s", c.expected, buf.String())
+		}
+	}
+}
+
+func TestExporterInvalidFormat(t *testing.T) {
+	if _, err := NewExporter("xml", "", &bytes.Buffer{}); err == nil {
+		t.Fatalf("Expected error for unsupported format")
+	}
+}
@@ -3,7 +3,10 @@ package common
 import (
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -83,3 +86,94 @@ func SanitizeDirname(dirname string) string {
 	// Double quotes are reserved, but single quotes are permitted.
 	return strings.ReplaceAll(sanitized, "\"", "'")
 }
+
+// MoveFile moves a file to the destination path, creating the
+// destination directory if needed.
+//
+// Falls back to copying and removing the source when the
+// destination is on a different file system.
+func MoveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := CopyFile(src, dst); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// CopyFile copies a file to the destination path, keeping the
+// modification time of the source.
+func CopyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Copy under a temporary name, so an interrupted
+	// copy never looks like a complete file.
+	tfp := filepath.Join(filepath.Dir(dst), TempFilename(filepath.Base(dst)))
+
+	err = func() error {
+		out, err := os.Create(tfp)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	}()
+
+	if err != nil {
+		_ = os.Remove(tfp)
+		return err
+	}
+
+	if err := os.Rename(tfp, dst); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, stat.ModTime(), stat.ModTime())
+}
+
+// WalkArchive calls the function for each downloaded file in
+// the output directory.
+//
+// Hidden files and folders are skipped. These hold the state of
+// the application, partial downloads and generated files such as
+// thumbnails, rather than artworks.
+func WalkArchive(root string, fn func(fp string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		hidden := strings.HasPrefix(info.Name(), ".") && fp != root
+
+		if info.IsDir() {
+			if hidden {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if hidden {
+			return nil
+		}
+
+		return fn(fp, info)
+	})
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Filter rejects assets that are not wanted, based on their
+// size, dimensions and type. Zero values disable a check.
+type Filter struct {
+	MinSize   int64
+	MaxSize   int64
+	MinWidth  int
+	MinHeight int
+
+	// Types lists the accepted file types, as normalised
+	// extensions. See `NormalizeType`.
+	Types []string
+}
+
+// SkipError indicates that an asset was deliberately not
+// downloaded, as opposed to a failed download.
+type SkipError struct {
+	URL    string
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return fmt.Sprintf("skipped '%s': %s", e.URL, e.Reason)
+}
+
+// IsSkipped checks whether the error indicates an asset
+// was skipped rather than failed.
+func IsSkipped(err error) bool {
+	var skip *SkipError
+	return errors.As(err, &skip)
+}
+
+// Enabled reports whether the filter has any checks configured.
+func (f *Filter) Enabled() bool {
+	return f != nil &&
+		(f.MinSize > 0 || f.MaxSize > 0 || f.MinWidth > 0 || f.MinHeight > 0 || len(f.Types) > 0)
+}
+
+// Check tests the asset against the filter using whatever is
+// currently known about it. Unknown properties pass.
+//
+// Returns a `*SkipError` if the asset should be skipped.
+func (f *Filter) Check(asset *Asset) error {
+	if !f.Enabled() {
+		return nil
+	}
+
+	skip := func(format string, args ...interface{}) error {
+		return &SkipError{URL: asset.URL, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if asset.Size > 0 {
+		if f.MinSize > 0 && asset.Size < f.MinSize {
+			return skip("size %s is below minimum %s", FormatByteSize(asset.Size), FormatByteSize(f.MinSize))
+		}
+		if f.MaxSize > 0 && asset.Size > f.MaxSize {
+			return skip("size %s exceeds maximum %s", FormatByteSize(asset.Size), FormatByteSize(f.MaxSize))
+		}
+	}
+
+	if f.MinWidth > 0 && asset.Width > 0 && asset.Width < f.MinWidth {
+		return skip("width %dpx is below minimum %dpx", asset.Width, f.MinWidth)
+	}
+
+	if f.MinHeight > 0 && asset.Height > 0 && asset.Height < f.MinHeight {
+		return skip("height %dpx is below minimum %dpx", asset.Height, f.MinHeight)
+	}
+
+	if len(f.Types) > 0 {
+		if t := asset.Type(); t != "" && !f.acceptsType(t) {
+			return skip("type '%s' is not one of %s", t, strings.Join(f.Types, ","))
+		}
+	}
+
+	return nil
+}
+
+// needsProbe reports whether the filter depends on properties
+// of the asset that a HEAD request could provide.
+func (f *Filter) needsProbe(asset *Asset) bool {
+	if !f.Enabled() {
+		return false
+	}
+
+	sizeUnknown := (f.MinSize > 0 || f.MaxSize > 0) && asset.Size <= 0
+	typeUnknown := len(f.Types) > 0 && asset.Type() == ""
+
+	return sizeUnknown || typeUnknown
+}
+
+// needsDimensions reports whether the filter depends on image
+// dimensions that are not yet known.
+func (f *Filter) needsDimensions(asset *Asset) bool {
+	return f.Enabled() &&
+		((f.MinWidth > 0 && asset.Width <= 0) || (f.MinHeight > 0 && asset.Height <= 0))
+}
+
+func (f *Filter) acceptsType(t string) bool {
+	for _, accepted := range f.Types {
+		if NormalizeType(accepted) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// probeAsset fills in the size and content type of the asset
+// using a HEAD request. Failures are ignored, since the server
+// may not support HEAD, and the download itself will tell.
+func probeAsset(client *http.Client, asset *Asset) {
+	req, err := newAssetRequest(http.MethodHead, asset)
+	if err != nil {
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	applyResponseHeaders(asset, resp)
+}
+
+// applyResponseHeaders fills in unknown properties of the asset
+// from the headers of a full (non-range) response.
+func applyResponseHeaders(asset *Asset, resp *http.Response) {
+	if asset.Size <= 0 && resp.ContentLength > 0 {
+		asset.Size = resp.ContentLength
+	}
+
+	if asset.ContentType == "" {
+		if ct := resp.Header.Get("Content-Type"); typeFromContentType(ct) != "" {
+			asset.ContentType = ct
+		}
+	}
+}
+
+// byteSizeUnits are the suffixes accepted by `ParseByteSize`,
+// ordered so longer suffixes are matched first.
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses a human readable size such as "500KB"
+// or "1.5GB". Units are powers of 1024. A plain number is
+// taken as bytes.
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// FormatByteSize formats a number of bytes for display.
+func FormatByteSize(n int64) string {
+	for _, unit := range byteSizeUnits[:4] {
+		if n >= unit.multiplier {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(unit.multiplier), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{
+		"100":   100,
+		"1KB":   1024,
+		"1.5MB": 1536 * 1024,
+		"5gb":   5 << 30,
+		"2 M":   2 << 20,
+	}
+
+	for input, expected := range cases {
+		// Act
+		actual, err := ParseByteSize(input)
+
+		// Assert
+		if err != nil {
+			t.Fatalf("Failed to parse '%s': %s", input, err)
+		}
+		if actual != expected {
+			t.Fatalf("Expected %d, actual %d", expected, actual)
+		}
+	}
+
+	if _, err := ParseByteSize("lots"); err == nil {
+		t.Fatalf("Expected error for invalid size")
+	}
+}
+
+func TestFilterCheck(t *testing.T) {
+	// Arrange
+	filter := &Filter{
+		MinSize:  1024,
+		MinWidth: 800,
+		Types:    []string{"jpg", "png"},
+	}
+
+	cases := []struct {
+		asset   Asset
+		skipped bool
+	}{
+		{Asset{URL: "https://example.com/a.jpeg", Size: 2048, Width: 1000}, false},
+		{Asset{URL: "https://example.com/a.jpg", Size: 100}, true},
+		{Asset{URL: "https://example.com/a.png", Width: 200}, true},
+		{Asset{URL: "https://example.com/a.gif"}, true},
+		{Asset{URL: "https://example.com/a", ContentType: "image/png"}, false},
+		{Asset{URL: "https://example.com/a.mp4"}, true},
+	}
+
+	for _, c := range cases {
+		// Act
+		err := filter.Check(&c.asset)
+
+		// Assert
+		if c.skipped != IsSkipped(err) {
+			t.Fatalf("Asset %+v: expected skipped %t, actual error: %v", c.asset, c.skipped, err)
+		}
+	}
+}
+
+func TestDownloadFileFiltersStream(t *testing.T) {
+	// Arrange
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 32))); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No extension, length or content type to go on
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	asset := Asset{URL: server.URL + "/image"}
+	options := DownloadOptions{Storage: NewLocalStorage(dir), Overwrite: true, Filter: &Filter{MinWidth: 100}}
+
+	// Act
+	_, err := DownloadFile(&asset, "image", options)
+
+	// Assert
+	if !IsSkipped(err) {
+		t.Fatalf("Expected skip, actual %v", err)
+	}
+	if asset.Width != 64 || asset.Height != 32 {
+		t.Fatalf("Expected dimensions 64x32, actual %dx%d", asset.Width, asset.Height)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "image")); !os.IsNotExist(err) {
+		t.Fatalf("Expected filtered file to not be written")
+	}
+}
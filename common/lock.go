@@ -0,0 +1,205 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// LockFilename is the name of the lock file created in the
+	// root of the output directory.
+	LockFilename string = ".art-dl.lock"
+
+	// lockHeartbeat is how often a running instance touches its
+	// lock file to show it is still alive.
+	lockHeartbeat time.Duration = time.Minute
+
+	// lockStaleAge is how old a lock file's modification time has
+	// to be before it is considered abandoned. This covers locks
+	// held by processes on other hosts, where we can't check
+	// whether the process is still running.
+	lockStaleAge time.Duration = 5 * lockHeartbeat
+
+	// lockPollInterval is how often a waiting instance checks
+	// whether the lock has been released.
+	lockPollInterval time.Duration = 2 * time.Second
+)
+
+// Lock is an exclusive lock on an output directory, preventing
+// two instances of the application from writing the same tree.
+type Lock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockInfo is the content written into the lock file, identifying
+// the owner of the lock.
+type lockInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+}
+
+// AcquireLock takes the lock on the given output directory.
+//
+// If another instance holds the lock, it waits up to the given
+// duration for it to be released. A wait of zero refuses
+// immediately. Locks left behind by crashed or killed
+// instances are detected as stale and taken over.
+func AcquireLock(directory string, wait time.Duration) (*Lock, error) {
+	fp := filepath.Join(directory, LockFilename)
+	deadline := time.Now().Add(wait)
+
+	for {
+		err := createLockFile(fp)
+		if err == nil {
+			lock := &Lock{
+				path: fp,
+				stop: make(chan struct{}),
+				done: make(chan struct{}),
+			}
+			go lock.heartbeat()
+			return lock, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file: %s", err)
+		}
+
+		info, stale := inspectLockFile(fp)
+		if stale {
+			if err := takeOverLockFile(fp); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			if info != nil {
+				return nil, fmt.Errorf("output directory '%s' is locked by process %d on %s since %s",
+					directory, info.PID, info.Hostname, info.Created.Format(time.RFC3339))
+			}
+			return nil, fmt.Errorf("output directory '%s' is locked by another process", directory)
+		}
+
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Release stops the heartbeat and removes the lock file.
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.done
+
+	return os.Remove(l.path)
+}
+
+// heartbeat periodically touches the lock file so other
+// instances can tell it is not stale.
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			_ = os.Chtimes(l.path, now, now)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// createLockFile atomically creates the lock file, failing
+// if it already exists.
+func createLockFile(fp string) error {
+	file, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hostname, _ := os.Hostname()
+	info := lockInfo{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Created:  time.Now(),
+	}
+
+	return json.NewEncoder(file).Encode(&info)
+}
+
+// takeOverLockFile removes a lock file found to be stale.
+//
+// Another instance may have taken the stale lock over since it was
+// inspected, and created a fresh one in its place. So the file is
+// first moved aside under a name of our own, which only one instance
+// can do, and inspected again. A lock that turns out to be fresh is
+// put back, without replacing any lock created meanwhile.
+func takeOverLockFile(fp string) error {
+	aside := fmt.Sprintf("%s.%d.%d", fp, os.Getpid(), time.Now().UnixNano())
+
+	if err := os.Rename(fp, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove stale lock file: %s", err)
+	}
+
+	if _, stale := inspectLockFile(aside); !stale {
+		err := os.Link(aside, fp)
+		_ = os.Remove(aside)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to restore lock file: %s", err)
+		}
+		return nil
+	}
+
+	if err := os.Remove(aside); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale lock file: %s", err)
+	}
+
+	return nil
+}
+
+// inspectLockFile reads an existing lock file and determines
+// whether its owner is gone.
+//
+// The returned info is nil when the file could not be parsed,
+// which can happen while another instance is still writing it.
+func inspectLockFile(fp string) (*lockInfo, bool) {
+	stat, err := os.Stat(fp)
+	if err != nil {
+		// Removed while we were looking. Try again.
+		return nil, os.IsNotExist(err)
+	}
+
+	if time.Since(stat.ModTime()) > lockStaleAge {
+		return nil, true
+	}
+
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, false
+	}
+
+	var info lockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, false
+	}
+
+	// Process liveness can only be checked on the same host.
+	hostname, _ := os.Hostname()
+	if info.Hostname == hostname && !processAlive(info.PID) {
+		return &info, true
+	}
+
+	return &info, false
+}
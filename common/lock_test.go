@@ -0,0 +1,85 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLockRefusesSecond(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	first, err := AcquireLock(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %s", err)
+	}
+
+	// Act
+	second, err := AcquireLock(dir, 0)
+
+	// Assert
+	if err == nil {
+		second.Release()
+		t.Fatalf("Expected second lock to be refused")
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatalf("Failed to release lock: %s", err)
+	}
+
+	third, err := AcquireLock(dir, 0)
+	if err != nil {
+		t.Fatalf("Expected lock after release, got: %s", err)
+	}
+	third.Release()
+}
+
+func TestAcquireLockStale(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	hostname, _ := os.Hostname()
+	b, _ := json.Marshal(lockInfo{PID: 999999999, Hostname: hostname})
+	if err := ioutil.WriteFile(filepath.Join(dir, LockFilename), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	lock, err := AcquireLock(dir, 0)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected stale lock to be taken over, got: %s", err)
+	}
+	lock.Release()
+}
+
+func TestTakeOverLockFileKeepsFreshLock(t *testing.T) {
+	// Arrange
+	// Another instance found the lock stale, but this one took it
+	// over and created a fresh one first.
+	dir := t.TempDir()
+	first, err := AcquireLock(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %s", err)
+	}
+	defer first.Release()
+
+	// Act
+	err = takeOverLockFile(filepath.Join(dir, LockFilename))
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := AcquireLock(dir, 0)
+	if err == nil {
+		second.Release()
+		t.Fatalf("Expected fresh lock to be kept")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, LockFilename+".*"))
+	if len(files) != 0 {
+		t.Fatalf("Expected no lock files left aside, actual %v", files)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"syscall"
+)
+
+// processAlive reports whether a process with the given PID
+// is running on this host.
+func processAlive(pid int) bool {
+	// Signal 0 performs error checking without
+	// actually sending a signal.
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package common
+
+import (
+	"os"
+)
+
+// processAlive reports whether a process with the given PID
+// is running on this host.
+func processAlive(pid int) bool {
+	// On Windows, finding a process opens a handle to it,
+	// which fails when the process does not exist.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+
+	return true
+}
@@ -0,0 +1,269 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ManifestFilename is the name of the manifest file created
+	// in the root of the output directory.
+	ManifestFilename string = ".art-dl-manifest.json"
+
+	// manifestSaveInterval is the number of changes after which
+	// the manifest is saved, so little is lost if the run is
+	// interrupted.
+	manifestSaveInterval int = 100
+)
+
+// ManifestEntry records a single downloaded file.
+type ManifestEntry struct {
+	// Path is relative to the output directory, using forward slashes
+	Path string `json:"path"`
+
+	// URL is where the file was downloaded from
+	URL string `json:"url"`
+
+	// Site and User identify the gallery the file belongs to
+	Site string `json:"site"`
+	User string `json:"user"`
+
+	// Size is the number of bytes on disk
+	Size int64 `json:"size"`
+
+	// Original is the path the file was downloaded to, when
+	// processors have since converted or moved it.
+	Original string `json:"original,omitempty"`
+
+	// Width and Height are the image dimensions in pixels,
+	// recorded when the image is fingerprinted.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// DHash and PHash are perceptual fingerprints of the image,
+	// used to find near-duplicates. Hexadecimal.
+	DHash string `json:"dhash,omitempty"`
+	PHash string `json:"phash,omitempty"`
+
+	// DuplicateOf is the path of the copy that was kept when this
+	// file was removed as a near-duplicate. The file is not
+	// downloaded again.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	// Downloaded is when the file was last downloaded
+	Downloaded time.Time `json:"downloaded"`
+}
+
+// Manifest keeps track of the files downloaded into an output
+// directory, across runs.
+type Manifest struct {
+	path    string
+	entries map[string]*ManifestEntry
+	urls    map[string]string // URL to path
+	changes int
+	lock    *sync.RWMutex // pointer to avoid copy
+}
+
+// manifestFile is the on-disk format of the manifest.
+type manifestFile struct {
+	Entries []*ManifestEntry `json:"entries"`
+}
+
+// NewManifest creates an empty manifest that is kept in memory
+// only, for runs that leave nothing on disk.
+func NewManifest() *Manifest {
+	return &Manifest{
+		entries: make(map[string]*ManifestEntry),
+		urls:    make(map[string]string),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+// LoadManifest reads the manifest from the output directory.
+//
+// A new empty manifest is returned if the directory doesn't
+// have one yet.
+func LoadManifest(directory string) (*Manifest, error) {
+	m := &Manifest{
+		path:    filepath.Join(directory, ManifestFilename),
+		entries: make(map[string]*ManifestEntry),
+		urls:    make(map[string]string),
+		lock:    &sync.RWMutex{},
+	}
+
+	b, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %s", err)
+	}
+
+	var data manifestFile
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest '%s': %s", m.path, err)
+	}
+
+	for _, entry := range data.Entries {
+		m.entries[entry.Path] = entry
+		if entry.URL != "" {
+			m.urls[entry.URL] = entry.Path
+		}
+	}
+
+	return m, nil
+}
+
+// Add records a downloaded file, replacing any previous entry
+// with the same path.
+func (m *Manifest) Add(entry ManifestEntry) {
+	m.lock.Lock()
+	m.entries[entry.Path] = &entry
+	if entry.URL != "" {
+		m.urls[entry.URL] = entry.Path
+	}
+	m.changes++
+	save := m.changes >= manifestSaveInterval
+	m.lock.Unlock()
+
+	if save {
+		_ = m.Save()
+	}
+}
+
+// Remove forgets the file at the given relative path.
+func (m *Manifest) Remove(path string) {
+	m.lock.Lock()
+	if entry, ok := m.entries[path]; ok {
+		if m.urls[entry.URL] == path {
+			delete(m.urls, entry.URL)
+		}
+		delete(m.entries, path)
+		m.changes++
+	}
+	m.lock.Unlock()
+}
+
+// Move changes the path of the entry at from, keeping the rest of
+// it. Unlike Add, it never saves the manifest, so a batch of moves
+// is saved all at once.
+//
+// Returns whether there was an entry to move.
+func (m *Manifest) Move(from string, to string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry, ok := m.entries[from]
+	if !ok {
+		return false
+	}
+
+	delete(m.entries, from)
+	entry.Path = to
+	m.entries[to] = entry
+	if entry.URL != "" && m.urls[entry.URL] == from {
+		m.urls[entry.URL] = to
+	}
+	m.changes++
+
+	return true
+}
+
+// Get returns the entry for the given relative path.
+func (m *Manifest) Get(path string) (ManifestEntry, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if entry, ok := m.entries[path]; ok {
+		return *entry, true
+	}
+	return ManifestEntry{}, false
+}
+
+// FindURL returns the entry of the file downloaded from the URL.
+func (m *Manifest) FindURL(url string) (ManifestEntry, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if path, ok := m.urls[url]; ok {
+		if entry, ok := m.entries[path]; ok {
+			return *entry, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// Entries returns a copy of all entries, ordered by path.
+func (m *Manifest) Entries() []ManifestEntry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	result := make([]ManifestEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		result = append(result, *entry)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+
+	return result
+}
+
+// Usage returns the total bytes downloaded for a site's gallery.
+// An empty user returns the total for the whole site.
+func (m *Manifest) Usage(site string, user string) int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var total int64
+	for _, entry := range m.entries {
+		if entry.Site == site && (user == "" || entry.User == user) {
+			total += entry.Size
+		}
+	}
+
+	return total
+}
+
+// Save writes the manifest to disk. Manifests kept in memory
+// are not saved.
+//
+// The manifest is written to a temporary file first and then
+// moved over the old one, so it's never left half written.
+func (m *Manifest) Save() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.path == "" {
+		return nil
+	}
+
+	data := manifestFile{Entries: make([]*ManifestEntry, 0, len(m.entries))}
+	for _, entry := range m.entries {
+		data.Entries = append(data.Entries, entry)
+	}
+	sort.Slice(data.Entries, func(i, j int) bool { return data.Entries[i].Path < data.Entries[j].Path })
+
+	b, err := json.MarshalIndent(&data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tfp := filepath.Join(filepath.Dir(m.path), TempFilename(filepath.Base(m.path)))
+	if err := ioutil.WriteFile(tfp, b, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %s", err)
+	}
+
+	if err := os.Rename(tfp, m.path); err != nil {
+		return fmt.Errorf("failed to write manifest: %s", err)
+	}
+
+	m.changes = 0
+
+	return nil
+}
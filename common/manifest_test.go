@@ -0,0 +1,37 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Add(ManifestEntry{Path: "deviantart/one/a.jpg", Site: "deviantart", User: "one", Size: 100})
+	m.Add(ManifestEntry{Path: "deviantart/one/b.jpg", Site: "deviantart", User: "one", Size: 50})
+	m.Add(ManifestEntry{Path: "deviantart/two/c.jpg", Site: "deviantart", User: "two", Size: 25})
+
+	// Act
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if len(loaded.Entries()) != 3 {
+		t.Fatalf("Expected %d, actual %d", 3, len(loaded.Entries()))
+	}
+	if usage := loaded.Usage("deviantart", "one"); usage != 150 {
+		t.Fatalf("Expected %d, actual %d", 150, usage)
+	}
+	if usage := loaded.Usage("deviantart", ""); usage != 175 {
+		t.Fatalf("Expected %d, actual %d", 175, usage)
+	}
+}
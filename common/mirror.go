@@ -0,0 +1,218 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// RemovedDirname is the folder in the root of the output
+	// directory that mirrored runs move files removed upstream to.
+	RemovedDirname string = ".removed"
+
+	// DefaultMirrorThreshold is the largest share of a gallery's
+	// files that a mirrored run removes.
+	DefaultMirrorThreshold float64 = 0.25
+
+	// removedTimeLayout names the quarantine folder of each run
+	removedTimeLayout string = "20060102-150405"
+)
+
+// mirror tracks which assets scrapers listed in each gallery, to
+// find the files that were removed upstream.
+type mirror struct {
+	// seen holds the URLs listed in each gallery
+	seen map[string]map[string]bool
+
+	// listed holds whether the listing of each gallery
+	// was walked to the end without failures.
+	listed map[string]bool
+
+	// stopped is set when the run stopped early, so scrapers
+	// may not have passed on everything they listed.
+	stopped bool
+
+	lock *sync.Mutex // pointer to avoid copy
+}
+
+func newMirror() *mirror {
+	return &mirror{
+		seen:   make(map[string]map[string]bool),
+		listed: make(map[string]bool),
+		lock:   &sync.Mutex{},
+	}
+}
+
+func galleryName(site, user string) string {
+	return site + "/" + user
+}
+
+// stop records that downloads stopped before the end of the run.
+func (m *mirror) stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stopped = true
+}
+
+func (m *mirror) see(asset *Asset) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	gallery := galleryName(asset.Site, asset.User)
+	if m.seen[gallery] == nil {
+		m.seen[gallery] = make(map[string]bool)
+	}
+	m.seen[gallery][asset.URL] = true
+}
+
+// Listed records that a scraper finished walking the listing of a
+// gallery, or failed to list some of it. A gallery with a failure
+// stays incomplete.
+//
+// Mirrored runs only remove files from galleries that were listed
+// completely.
+func (s *Session) Listed(site, user string, err error) {
+	if s.mirror == nil {
+		return
+	}
+
+	s.mirror.lock.Lock()
+	defer s.mirror.lock.Unlock()
+
+	gallery := galleryName(site, user)
+	complete, ok := s.mirror.listed[gallery]
+	s.mirror.listed[gallery] = err == nil && (complete || !ok)
+}
+
+// applyMirror removes the files of completely listed galleries
+// whose assets weren't listed anymore, either into the quarantine
+// folder or for good when pruning.
+//
+// Galleries where a larger share of files than the threshold would
+// be removed are left alone, since the listing is more likely to
+// be broken than the artist to have removed that much. Runs that
+// stopped early remove nothing.
+func (s *Session) applyMirror() error {
+	s.mirror.lock.Lock()
+	defer s.mirror.lock.Unlock()
+
+	if s.mirror.stopped {
+		log.Println("Mirror: Run stopped early, leaving files of all galleries alone")
+		return nil
+	}
+
+	threshold := s.Config.MirrorThreshold
+	if threshold <= 0 {
+		threshold = DefaultMirrorThreshold
+	}
+
+	galleries := make([]string, 0, len(s.mirror.listed))
+	for gallery := range s.mirror.listed {
+		galleries = append(galleries, gallery)
+	}
+	sort.Strings(galleries)
+
+	entries := s.Manifest.Entries()
+	stamp := time.Now().Format(removedTimeLayout)
+
+	for _, gallery := range galleries {
+		seen := s.mirror.seen[gallery]
+
+		if !s.mirror.listed[gallery] || len(seen) == 0 {
+			log.Printf("Mirror: Listing of %s is incomplete, leaving its files alone", gallery)
+			continue
+		}
+
+		var local int
+		gone := make([]ManifestEntry, 0)
+		for _, entry := range entries {
+			// Adopted files that weren't matched have no URL
+			if galleryName(entry.Site, entry.User) != gallery || entry.DuplicateOf != "" || entry.URL == "" {
+				continue
+			}
+			if exists, err := s.Storage.Exists(entry.Path); err != nil || !exists {
+				continue
+			}
+
+			local++
+			if !seen[entry.URL] {
+				gone = append(gone, entry)
+			}
+		}
+
+		if len(gone) == 0 {
+			continue
+		}
+
+		if float64(len(gone)) > threshold*float64(local) {
+			log.Printf("Mirror: %d of %d files of %s are gone upstream, over the threshold of %.0f%%, leaving them alone",
+				len(gone), local, gallery, threshold*100)
+			continue
+		}
+
+		for _, entry := range gone {
+			if err := s.removeGone(entry.Path, stamp); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeGone removes a file that is gone upstream. Dry runs only
+// print it.
+func (s *Session) removeGone(key string, stamp string) error {
+	if s.planner != nil {
+		s.planner.Removal(key)
+		return nil
+	}
+
+	if s.Config.Prune {
+		if err := s.Storage.Delete(key); err != nil {
+			return fmt.Errorf("failed to prune '%s': %s", key, err)
+		}
+		log.Println("Mirror: Pruned", key)
+	} else {
+		dst := JoinKey(RemovedDirname, stamp, key)
+		if err := s.quarantine(key, dst); err != nil {
+			return fmt.Errorf("failed to move '%s' to '%s': %s", key, dst, err)
+		}
+		log.Printf("Mirror: Moved %s to %s", key, dst)
+	}
+
+	s.Manifest.Remove(key)
+
+	return s.Catalog.Removed(key)
+}
+
+// quarantine moves a stored file to another key.
+func (s *Session) quarantine(src, dst string) error {
+	switch storage := s.Storage.(type) {
+	case FileStorage:
+		return MoveFile(storage.LocalPath(src), storage.LocalPath(dst))
+
+	case ReadableStorage:
+		r, err := storage.Open(src)
+		if err != nil {
+			return err
+		}
+		info, err := storage.Stat(src)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		err = storage.Put(dst, r, info.ModTime)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		return storage.Delete(src)
+	}
+
+	return fmt.Errorf("storage can't move files, prune them instead")
+}
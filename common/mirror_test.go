@@ -0,0 +1,179 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vangroan/art-dl/internal/testutil"
+)
+
+// newMirroredSession creates a session over a gallery of files a
+// to d, which are in the manifest.
+func newMirroredSession(t *testing.T, config *Config) *Session {
+	dir := t.TempDir()
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		testutil.WriteFiles(t, dir, "deviantart/one/"+name)
+		manifest.Add(ManifestEntry{
+			Path: "deviantart/one/" + name,
+			URL:  "https://example.com/" + name,
+			Site: "deviantart",
+			User: "one",
+		})
+	}
+	if err := manifest.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Directory = dir
+	config.Mirror = true
+	session, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// list downloads the named files of the gallery, which already
+// exist.
+func list(t *testing.T, session *Session, names ...string) {
+	for _, name := range names {
+		asset := Asset{URL: "https://example.com/" + name, Site: "deviantart", User: "one"}
+		if _, err := session.Download(&asset, "{site}/{user}/{filename}"); err != nil && !IsSkipped(err) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMirrorQuarantine(t *testing.T) {
+	// Arrange
+	session := newMirroredSession(t, &Config{})
+	dir := session.Config.Directory
+
+	// Act
+	list(t, session, "a.jpg", "b.jpg", "c.jpg")
+	session.Listed("deviantart", "one", nil)
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if _, err := os.Stat(filepath.Join(dir, "deviantart", "one", "d.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("Expected d.jpg to be moved")
+	}
+	moved, err := filepath.Glob(filepath.Join(dir, RemovedDirname, "*", "deviantart", "one", "d.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 {
+		t.Fatalf("Expected 1 file in %s, actual %d", RemovedDirname, len(moved))
+	}
+
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest.Get("deviantart/one/d.jpg"); ok {
+		t.Fatalf("Expected d.jpg to be removed from the manifest")
+	}
+	if _, ok := manifest.Get("deviantart/one/a.jpg"); !ok {
+		t.Fatalf("Expected a.jpg to stay in the manifest")
+	}
+}
+
+func TestMirrorPrune(t *testing.T) {
+	// Arrange
+	session := newMirroredSession(t, &Config{Prune: true})
+	dir := session.Config.Directory
+
+	// Act
+	list(t, session, "a.jpg", "b.jpg", "c.jpg")
+	session.Listed("deviantart", "one", nil)
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if _, err := os.Stat(filepath.Join(dir, "deviantart", "one", "d.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("Expected d.jpg to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, RemovedDirname)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no %s folder", RemovedDirname)
+	}
+}
+
+func TestMirrorThreshold(t *testing.T) {
+	// Arrange
+	session := newMirroredSession(t, &Config{})
+	dir := session.Config.Directory
+
+	// Act
+	list(t, session, "a.jpg", "b.jpg")
+	session.Listed("deviantart", "one", nil)
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	files, err := filepath.Glob(filepath.Join(dir, "deviantart", "one", "*.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("Expected %d files, actual %d", 4, len(files))
+	}
+}
+
+func TestMirrorIncompleteListing(t *testing.T) {
+	// Arrange
+	session := newMirroredSession(t, &Config{})
+	dir := session.Config.Directory
+
+	// Act
+	list(t, session, "a.jpg", "b.jpg", "c.jpg")
+	session.Listed("deviantart", "one", nil)
+	session.Listed("deviantart", "one", errors.New("project failed"))
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	files, err := filepath.Glob(filepath.Join(dir, "deviantart", "one", "*.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("Expected %d files, actual %d", 4, len(files))
+	}
+}
+
+func TestMirrorStoppedEarly(t *testing.T) {
+	// Arrange
+	session := newMirroredSession(t, &Config{MirrorThreshold: 1, MinFreeSpace: 1 << 62})
+	dir := session.Config.Directory
+
+	// Act
+	list(t, session, "a.jpg", "b.jpg")
+	asset := Asset{URL: "https://example.com/e.jpg", Site: "deviantart", User: "one"}
+	if _, err := session.Download(&asset, "{site}/{user}/{filename}"); !errors.Is(err, ErrDiskSpace) {
+		t.Fatalf("Expected %v, actual %v", ErrDiskSpace, err)
+	}
+	session.Listed("deviantart", "one", nil)
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	files, err := filepath.Glob(filepath.Join(dir, "deviantart", "one", "*.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("Expected %d files, actual %d", 4, len(files))
+	}
+}
@@ -1,65 +1,242 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"hash"
+	"image"
+	_ "image/gif"  // register decoder for DecodeConfig
+	_ "image/jpeg" // register decoder for DecodeConfig
+	_ "image/png"  // register decoder for DecodeConfig
 	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-// DownloadFile downloads a file to the target folder. If
-// a file with same name exists. The file can be overwritten
-// by setting the `overwrite` parameter.
+const (
+	tempPrefix string = "."
+	tempSuffix string = ".tmp"
+)
+
+// DownloadOptions controls how `DownloadFile` fetches and
+// stores a file.
+type DownloadOptions struct {
+	// Storage receives the downloaded file.
+	Storage Storage
+
+	// Overwrite replaces an existing file with the same name.
+	Overwrite bool
+
+	// Filter rejects unwanted assets. May be nil.
+	Filter *Filter
+
+	// Guard stops downloads when disk space runs low. May be nil.
+	Guard *DiskGuard
+
+	// Client sends the requests. Default is `http.DefaultClient`.
+	Client *http.Client
+
+	// Hash receives the content of the file as it's downloaded,
+	// eg. to checksum it without reading it back. May be nil.
+	Hash hash.Hash
+}
+
+// inspectSize is how much of the response body is buffered to
+// sniff the content type and image dimensions.
+const inspectSize int = 64 * 1024
+
+// DownloadFile downloads an asset and stores it under the key,
+// such as "deviantart/username/image.jpg". If a file with same
+// key exists. The file can be overwritten by setting the
+// `Overwrite` option.
 //
-// Returns the file path if the download was successful,
-// an error if the file already exists, or the download
-// failed.
-func DownloadFile(fileURL string, targetFolder string, overwrite bool) (string, error) {
-	// Determine filename
-	u, err := url.Parse(fileURL)
-	if err != nil {
-		return "", err
+// The asset is checked against the filter as early as possible.
+// First using the metadata provided by the scraper, then the
+// headers of a HEAD request, and finally by inspecting the
+// start of the downloaded stream.
+//
+// With local storage, the file is downloaded next to its final
+// location. If a partially downloaded temporary file was left
+// behind by an interrupted run, the download is resumed from
+// where it stopped, provided the server supports range requests.
+// Other storages receive the file once it's complete.
+//
+// The modification time of the file is set to the publish date
+// of the asset when known, or else the server's Last-Modified.
+//
+// Returns the storage key if the download was successful,
+// a `*SkipError` if the asset was filtered out, or an error
+// if the file already exists, or the download failed.
+func DownloadFile(asset *Asset, key string, options DownloadOptions) (string, error) {
+	storage := options.Storage
+	if storage == nil {
+		return "", fmt.Errorf("no storage to download '%s' to", asset.URL)
 	}
 
-	fn := path.Base(u.Path)
-	fp := filepath.Join(targetFolder, fn)
+	fn := path.Base(key)
 
 	// Ensure file does not exist
-	if !overwrite {
-		if _, err := os.Stat(fp); !os.IsNotExist(err) {
-			return "", fmt.Errorf("file '%s' exists", fp)
+	if !options.Overwrite {
+		exists, err := storage.Exists(key)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("file '%s' exists", key)
 		}
 	}
 
-	// Start file download
-	resp, err := http.Get(fileURL)
-	if err != nil {
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// Filter using metadata from the scraper,
+	// then ask the server for what's missing.
+	filter := options.Filter
+	if err := filter.Check(asset); err != nil {
+		return "", err
+	}
+
+	if filter.needsProbe(asset) {
+		probeAsset(client, asset)
+
+		if err := filter.Check(asset); err != nil {
+			return "", err
+		}
+	}
+
+	// Don't start what can't be finished
+	if err := options.Guard.Check(); err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
 	// Temporary file name.
 	// Partially downloaded file gets saved under
 	// a temporary file name, then moved to the final
-	// file name when done.
-	tfn := "." + fn + ".tmp"
-	tfp := filepath.Join(targetFolder, tfn)
+	// file name when done. Storages that keep nothing
+	// on disk get a buffer instead.
+	var tfp string
+	var buffer *bytes.Buffer
+	fileStorage, local := storage.(FileStorage)
+	switch {
+	case local:
+		dir := filepath.Dir(fileStorage.LocalPath(key))
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return "", err
+		}
+		tfp = filepath.Join(dir, TempFilename(fn))
+	case bufferInMemory(storage):
+		buffer = &bytes.Buffer{}
+	default:
+		spool, err := ioutil.TempFile("", TempFilename(fn)+"-*")
+		if err != nil {
+			return "", err
+		}
+		_ = spool.Close()
+		tfp = spool.Name()
+		defer os.Remove(tfp)
+	}
+
+	// Check for a partial download to resume
+	var offset int64
+	if stat, err := os.Stat(tfp); local && err == nil {
+		offset = stat.Size()
+	}
+
+	req, err := newAssetRequest(http.MethodGet, asset)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// Start file download
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("unexpected status '%s' downloading '%s'", resp.Status, asset.URL)
+	}
+
+	// The server may ignore the range and send the
+	// whole file, in which case we start over.
+	resume := offset > 0 &&
+		resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset))
+
+	var body io.Reader = resp.Body
+
+	// Last resort filtering on the stream itself. Only possible
+	// when we're receiving the start of the file.
+	if !resume && filter.Enabled() {
+		applyResponseHeaders(asset, resp)
+
+		buffered := bufio.NewReaderSize(resp.Body, inspectSize)
+		inspectStream(asset, buffered, filter.needsDimensions(asset))
+		body = buffered
+
+		if err := filter.Check(asset); err != nil {
+			return "", err
+		}
+	}
+
+	// Guard against servers that don't report a length.
+	// Read one byte past the maximum to detect overflow.
+	limited := false
+	if filter.Enabled() && filter.MaxSize > 0 {
+		remaining := filter.MaxSize + 1
+		if resume {
+			remaining -= offset
+		}
+		body = io.LimitReader(body, remaining)
+		limited = true
+	}
+
+	if options.Hash != nil {
+		body = io.TeeReader(body, options.Hash)
+	}
 
 	// Close file before rename, because Windows locks
 	// the file handle.
+	var written int64
 	err = func() error {
-		// Create new file
-		file, err := os.Create(tfp)
+		if buffer != nil {
+			written, err = io.Copy(buffer, body)
+			return err
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if resume {
+			flags = os.O_WRONLY | os.O_APPEND
+
+			// The hash starts with what the interrupted run downloaded
+			if options.Hash != nil {
+				if err := hashLocalFile(options.Hash, tfp); err != nil {
+					return err
+				}
+			}
+		}
+
+		file, err := os.OpenFile(tfp, flags, 0666)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
 
-		// Stream download into file
-		_, err = io.Copy(file, resp.Body)
+		// Stream download into file, keeping an
+		// eye on the remaining disk space.
+		written, err = io.Copy(&guardedWriter{w: file, guard: options.Guard}, body)
 		if err != nil {
 			return err
 		}
@@ -71,12 +248,176 @@ func DownloadFile(fileURL string, targetFolder string, overwrite bool) (string,
 		return "", err
 	}
 
+	if resume {
+		written += offset
+	}
+
+	if limited && written > filter.MaxSize {
+		_ = os.Remove(tfp)
+		return "", &SkipError{
+			URL:    asset.URL,
+			Reason: fmt.Sprintf("size exceeds maximum %s", FormatByteSize(filter.MaxSize)),
+		}
+	}
+
 	// Move temporary file into final
 	// file location.
-	err = os.Rename(tfp, fp)
+	mtime := modTime(asset, resp)
+	switch {
+	case local:
+		err = commitFile(tfp, fileStorage.LocalPath(key), mtime)
+	case buffer != nil:
+		err = putAsset(storage, key, bytes.NewReader(buffer.Bytes()), mtime, asset)
+	default:
+		err = putFile(storage, key, tfp, mtime, asset)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	return "", nil
+	return key, nil
+}
+
+// commitFile moves a complete file into its final location,
+// and sets its modification time when not zero.
+func commitFile(src, dst string, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	if !modTime.IsZero() {
+		return os.Chtimes(dst, time.Now(), modTime)
+	}
+
+	return nil
+}
+
+// putFile uploads a complete local file to the storage.
+func putFile(storage Storage, key string, fp string, modTime time.Time, asset *Asset) error {
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return putAsset(storage, key, file, modTime, asset)
+}
+
+// putAsset stores the file along with the asset's metadata, when
+// the storage keeps it.
+func putAsset(storage Storage, key string, r io.Reader, modTime time.Time, asset *Asset) error {
+	if s, ok := storage.(AssetStorage); ok {
+		return s.PutAsset(key, r, modTime, asset)
+	}
+
+	return storage.Put(key, r, modTime)
+}
+
+// modTime determines the modification time a downloaded file
+// should have. Returns zero if nothing better than the time of
+// download is known.
+func modTime(asset *Asset, resp *http.Response) time.Time {
+	if !asset.Published.IsZero() {
+		return asset.Published
+	}
+
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// newAssetRequest creates a request for the asset's file,
+// including the headers the scraper gave it.
+func newAssetRequest(method string, asset *Asset) (*http.Request, error) {
+	req, err := http.NewRequest(method, asset.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range asset.Headers {
+		req.Header[key] = values
+	}
+
+	return req, nil
+}
+
+// inspectStream peeks at the start of the response body to
+// determine the content type and, if requested, the image
+// dimensions, without consuming the reader.
+func inspectStream(asset *Asset, r *bufio.Reader, dimensions bool) {
+	// Peek returns what it could read along with an
+	// error when the body is shorter than requested.
+	head, _ := r.Peek(inspectSize)
+	if len(head) == 0 {
+		return
+	}
+
+	if asset.ContentType == "" {
+		asset.ContentType = http.DetectContentType(head)
+	}
+
+	if dimensions {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+			asset.Width = cfg.Width
+			asset.Height = cfg.Height
+		}
+	}
+}
+
+// TempFilename returns the name a file is downloaded
+// under before it is complete.
+func TempFilename(filename string) string {
+	return tempPrefix + filename + tempSuffix
+}
+
+// isTempFilename checks whether the filename is that of
+// a partially downloaded file.
+func isTempFilename(filename string) bool {
+	return len(filename) > len(tempPrefix)+len(tempSuffix) &&
+		strings.HasPrefix(filename, tempPrefix) &&
+		strings.HasSuffix(filename, tempSuffix)
+}
+
+// SweepTempFiles walks the output directory looking for partial
+// downloads left behind by a crashed or killed run.
+//
+// When `keep` is true the files are left in place so the next
+// download of the same file resumes them. Otherwise they are
+// removed.
+//
+// Returns the number of temporary files found.
+func SweepTempFiles(root string, keep bool) (int, error) {
+	count := 0
+
+	err := filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The output directory may not exist yet on first run
+			if os.IsNotExist(err) && fp == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if info.IsDir() || !isTempFilename(info.Name()) {
+			return nil
+		}
+
+		count++
+
+		if keep {
+			return nil
+		}
+
+		return os.Remove(fp)
+	})
+
+	return count, err
 }
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileModTime(t *testing.T) {
+	// Arrange
+	lastModified := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	published := time.Date(2017, 3, 4, 8, 30, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		asset    Asset
+		expected time.Time
+	}{
+		{Asset{URL: server.URL + "/a.jpg"}, lastModified},
+		{Asset{URL: server.URL + "/b.jpg", Published: published}, published},
+	}
+
+	for _, c := range cases {
+		// Act
+		storage := NewLocalStorage(t.TempDir())
+		key, err := DownloadFile(&c.asset, "gallery/"+c.asset.Filename(), DownloadOptions{Storage: storage, Overwrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Assert
+		stat, err := os.Stat(storage.LocalPath(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stat.ModTime().Equal(c.expected) {
+			t.Fatalf("Expected %s, actual %s", c.expected, stat.ModTime())
+		}
+	}
+}
+
+func TestDownloadFileResumeHash(t *testing.T) {
+	// Arrange
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.Header.Get("Range")
+		http.ServeContent(w, r, "a.jpg", time.Time{}, strings.NewReader("data"))
+	}))
+	defer server.Close()
+	storage := NewLocalStorage(t.TempDir())
+	if err := os.MkdirAll(filepath.Dir(storage.LocalPath("gallery/a.jpg")), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(filepath.Dir(storage.LocalPath("gallery/a.jpg")), TempFilename("a.jpg"))
+	if err := ioutil.WriteFile(partial, []byte("da"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asset := Asset{URL: server.URL + "/a.jpg"}
+	h := sha256.New()
+
+	// Act
+	_, err := DownloadFile(&asset, "gallery/a.jpg", DownloadOptions{Storage: storage, Overwrite: true, Hash: h})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != "bytes=2-" {
+		t.Fatalf("Expected download to resume, actual range '%s'", requested)
+	}
+	// SHA-256 of "data"
+	expected := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		t.Fatalf("Expected %s, actual %s", expected, actual)
+	}
+}
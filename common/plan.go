@@ -0,0 +1,101 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	planNew      string = "new"
+	planExists   string = "exists"
+	planFiltered string = "filtered"
+	planRemoved  string = "removed"
+)
+
+// planner prints what a dry run would download, and sums it up
+// per gallery.
+type planner struct {
+	w         io.Writer
+	galleries map[string]*galleryPlan
+	lock      *sync.Mutex // pointer to avoid copy
+}
+
+// galleryPlan counts the assets planned for a gallery. Bytes is
+// the size of the new assets whose size is known.
+type galleryPlan struct {
+	assets   int
+	new      int
+	exists   int
+	filtered int
+	bytes    int64
+}
+
+func newPlanner(w io.Writer) *planner {
+	return &planner{
+		w:         w,
+		galleries: make(map[string]*galleryPlan),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Plan prints an asset that would be stored under the key, and
+// whether it would be downloaded.
+func (p *planner) Plan(asset *Asset, key string, status string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	gallery := asset.Site + "/" + asset.User
+	plan, ok := p.galleries[gallery]
+	if !ok {
+		plan = &galleryPlan{}
+		p.galleries[gallery] = plan
+	}
+
+	plan.assets++
+	switch status {
+	case planNew:
+		plan.new++
+		plan.bytes += asset.Size
+	case planExists:
+		plan.exists++
+	case planFiltered:
+		plan.filtered++
+	}
+
+	fmt.Fprintf(p.w, "%-8s %s <- %s\n", status, key, asset.URL)
+}
+
+// Removal prints a file a mirrored run would remove.
+func (p *planner) Removal(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprintf(p.w, "%-8s %s\n", planRemoved, key)
+}
+
+// Summary prints the totals of each gallery.
+func (p *planner) Summary() {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	names := make([]string, 0, len(p.galleries))
+	for name := range p.galleries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		plan := p.galleries[name]
+		fmt.Fprintf(p.w, "%s: %d assets, %d new, %d exist, %d filtered", name, plan.assets, plan.new, plan.exists, plan.filtered)
+		if plan.bytes > 0 {
+			fmt.Fprintf(p.w, ", at least %s to download", FormatByteSize(plan.bytes))
+		}
+		fmt.Fprintln(p.w)
+	}
+}
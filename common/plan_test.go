@@ -0,0 +1,62 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSessionDryRun(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "deviantart", "one"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "deviantart", "one", "a.jpg"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Directory: dir, DryRun: true}
+	config.Filter.Types = []string{"png"}
+	session, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	session.planner = newPlanner(&buf)
+	assets := []Asset{
+		{URL: "https://example.com/a.jpg", Site: "deviantart", User: "one"},
+		{URL: "https://example.com/b.png", Site: "deviantart", User: "one", Size: 2048},
+		{URL: "https://example.com/c.jpg", Site: "deviantart", User: "one"},
+	}
+
+	// Act
+	for i := range assets {
+		if _, err := session.Download(&assets[i], "{site}/{user}/{filename}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	expected := []string{
+		"exists   deviantart/one/a.jpg <- https://example.com/a.jpg",
+		"new      deviantart/one/b.png <- https://example.com/b.png",
+		"filtered deviantart/one/c.jpg <- https://example.com/c.jpg",
+		"deviantart/one: 3 assets, 1 new, 1 exist, 1 filtered, at least 2.0KB to download",
+	}
+	actual := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected %s, actual %s", strings.Join(expected, "\n"), buf.String())
+	}
+
+	for _, name := range []string{ManifestFilename, CatalogFilename} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s not to be written", name)
+		}
+	}
+}
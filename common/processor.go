@@ -0,0 +1,153 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// Processor performs work on a file after it has been
+// successfully downloaded.
+type Processor interface {
+	// Name identifies the processor in logs
+	Name() string
+
+	// Process works on the file at the given path, using the
+	// metadata of the asset it was downloaded from.
+	//
+	// Returns the path of the resulting file, which differs
+	// from the given path if the file was moved or replaced.
+	// A processor must leave the given file intact when it
+	// fails.
+	Process(fp string, asset *Asset) (string, error)
+}
+
+// ProcessorFactoryFunc is a factory function that is expected
+// to create an instance of a `Processor`, given the options
+// from the config file.
+type ProcessorFactoryFunc func(session *Session, options map[string]string) (Processor, error)
+
+// ProcessorEntry maps a processor name, as used in the config
+// file, to a factory.
+type ProcessorEntry struct {
+	name    string
+	factory ProcessorFactoryFunc
+}
+
+// MapProcessor is a helper for creating a `ProcessorEntry`.
+func MapProcessor(name string, factory ProcessorFactoryFunc) ProcessorEntry {
+	return ProcessorEntry{
+		name:    name,
+		factory: factory,
+	}
+}
+
+// ProcessorConfig configures a single processor in a chain.
+type ProcessorConfig struct {
+	// Name of the processor as given to `MapProcessor`
+	Name string `json:"name"`
+
+	// Types limits the processor to files of these types.
+	// Default is all types.
+	Types []string `json:"types"`
+
+	// Options are passed to the processor's factory
+	Options map[string]string `json:"options"`
+}
+
+// ProcessorChain runs processors in order over a file.
+type ProcessorChain struct {
+	links []chainLink
+}
+
+type chainLink struct {
+	processor Processor
+	types     []string
+}
+
+// NewProcessorChain instantiates the configured processors using
+// the factories in the given mappings.
+func NewProcessorChain(session *Session, configs []ProcessorConfig, entries []ProcessorEntry) (*ProcessorChain, error) {
+	chain := &ProcessorChain{links: make([]chainLink, 0, len(configs))}
+
+	for _, cfg := range configs {
+		var factory ProcessorFactoryFunc
+		for _, entry := range entries {
+			if entry.name == cfg.Name {
+				factory = entry.factory
+				break
+			}
+		}
+
+		if factory == nil {
+			return nil, fmt.Errorf("unknown processor '%s'", cfg.Name)
+		}
+
+		processor, err := factory(session, cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create processor '%s': %s", cfg.Name, err)
+		}
+
+		types := make([]string, 0, len(cfg.Types))
+		for _, t := range cfg.Types {
+			types = append(types, NormalizeType(t))
+		}
+
+		chain.links = append(chain.links, chainLink{processor: processor, types: types})
+	}
+
+	return chain, nil
+}
+
+// Len returns the number of processors in the chain.
+func (c *ProcessorChain) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.links)
+}
+
+// Run passes the file through each processor in turn.
+//
+// When a processor fails, the chain stops and the error is
+// returned along with the path of the last good file, so
+// the download is never lost.
+func (c *ProcessorChain) Run(fp string, asset *Asset) (string, error) {
+	if c == nil {
+		return fp, nil
+	}
+
+	for _, link := range c.links {
+		if !link.accepts(fp) {
+			continue
+		}
+
+		result, err := link.processor.Process(fp, asset)
+		if err != nil {
+			return fp, fmt.Errorf("processor '%s' failed on '%s': %w", link.processor.Name(), fp, err)
+		}
+
+		if result != fp {
+			log.Printf("Processor '%s': %s -> %s", link.processor.Name(), fp, result)
+		}
+
+		fp = result
+	}
+
+	return fp, nil
+}
+
+func (l *chainLink) accepts(fp string) bool {
+	if len(l.types) == 0 {
+		return true
+	}
+
+	t := NormalizeType(filepath.Ext(fp))
+	for _, accepted := range l.types {
+		if accepted == t {
+			return true
+		}
+	}
+
+	return false
+}
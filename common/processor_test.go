@@ -0,0 +1,63 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+type renameProcessor struct {
+	suffix string
+	fail   bool
+}
+
+func (p *renameProcessor) Name() string { return "rename" }
+
+func (p *renameProcessor) Process(fp string, asset *Asset) (string, error) {
+	if p.fail {
+		return fp, errors.New("failed")
+	}
+	return fp + p.suffix, nil
+}
+
+func TestProcessorChain(t *testing.T) {
+	// Arrange
+	newRename := func(session *Session, options map[string]string) (Processor, error) {
+		return &renameProcessor{suffix: options["suffix"], fail: options["fail"] == "true"}, nil
+	}
+	entries := []ProcessorEntry{MapProcessor("rename", newRename)}
+
+	configs := []ProcessorConfig{
+		{Name: "rename", Options: map[string]string{"suffix": ".a"}},
+		{Name: "rename", Types: []string{"png"}, Options: map[string]string{"suffix": ".b"}},
+		{Name: "rename", Options: map[string]string{"suffix": ".c"}},
+		{Name: "rename", Options: map[string]string{"fail": "true"}},
+		{Name: "rename", Options: map[string]string{"suffix": ".d"}},
+	}
+	chain, err := NewProcessorChain(nil, configs, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	fp, err := chain.Run("image.jpg", &Asset{})
+
+	// Assert
+	if err == nil {
+		t.Fatalf("Expected processor error")
+	}
+
+	expected := "image.jpg.a.c"
+	if fp != expected {
+		t.Fatalf("Expected %s, actual %s", expected, fp)
+	}
+}
+
+func TestProcessorChainUnknown(t *testing.T) {
+	// Act
+	_, err := NewProcessorChain(nil, []ProcessorConfig{{Name: "missing"}}, nil)
+
+	// Assert
+	if err == nil {
+		t.Fatalf("Expected error for unknown processor")
+	}
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Query selects artworks in the catalog, parsed from a search like
+// `dragon tag:concept site:artstation after:2019-01-01`.
+//
+// Terms are separated by spaces, and double quotes group words
+// into a single term. A term is one of:
+//
+//	word            in the title, description or tags
+//	title:word      in the title
+//	desc:word       in the description
+//	tag:name        has the tag
+//	artist:name     by the artist, also user:name
+//	site:name       from the site
+//	after:date      published on or after the date
+//	before:date     published before the date
+//
+// Dates are written as 2019, 2019-07 or 2019-07-19. Text is
+// matched case insensitively. Terms starting with a dash exclude
+// artworks instead, eg. -tag:sketch. All terms must match.
+type Query struct {
+	terms []queryTerm
+}
+
+type queryTerm struct {
+	field  string
+	value  string
+	date   time.Time
+	negate bool
+}
+
+// queryFields are the field names of terms.
+var queryFields = map[string]string{
+	"title":  "title",
+	"desc":   "desc",
+	"tag":    "tag",
+	"artist": "artist",
+	"user":   "artist",
+	"site":   "site",
+	"after":  "after",
+	"before": "before",
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// ParseQuery parses a search. An empty search matches everything.
+func ParseQuery(text string) (*Query, error) {
+	q := &Query{}
+
+	tokens, err := splitQuery(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		term := queryTerm{}
+
+		if strings.HasPrefix(token, "-") && len(token) > 1 {
+			term.negate = true
+			token = token[1:]
+		}
+
+		if i := strings.IndexByte(token, ':'); i > 0 {
+			if field, ok := queryFields[strings.ToLower(token[:i])]; ok {
+				term.field = field
+				token = token[i+1:]
+			}
+		}
+
+		term.value = strings.ToLower(token)
+
+		if term.field == "after" || term.field == "before" {
+			date, err := parseQueryDate(token)
+			if err != nil {
+				return nil, err
+			}
+			term.date = date
+		}
+
+		q.terms = append(q.terms, term)
+	}
+
+	return q, nil
+}
+
+// splitQuery splits a search into terms at spaces outside quotes.
+// Quotes are removed.
+func splitQuery(text string) ([]string, error) {
+	tokens := make([]string, 0)
+
+	var b strings.Builder
+	quoted := false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if b.Len() > 0 {
+				tokens = append(tokens, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("search has an unclosed quote")
+	}
+	if b.Len() > 0 {
+		tokens = append(tokens, b.String())
+	}
+
+	return tokens, nil
+}
+
+func parseQueryDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s', expected 2019, 2019-07 or 2019-07-19", value)
+}
+
+// Match checks whether the artwork satisfies all the terms.
+func (q *Query) Match(artwork *ArtworkRecord) bool {
+	for _, term := range q.terms {
+		if term.match(artwork) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *queryTerm) match(artwork *ArtworkRecord) bool {
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), t.value)
+	}
+	description := func() string {
+		return htmlTagPattern.ReplaceAllString(artwork.Description, " ")
+	}
+
+	switch t.field {
+	case "title":
+		return contains(artwork.Title)
+	case "desc":
+		return contains(description())
+	case "tag":
+		for _, tag := range artwork.Tags {
+			if strings.ToLower(tag) == t.value {
+				return true
+			}
+		}
+		return false
+	case "artist":
+		return strings.ToLower(artwork.User) == t.value
+	case "site":
+		return strings.ToLower(artwork.Site) == t.value
+	case "after":
+		return !artwork.Published.IsZero() && !artwork.Published.Before(t.date)
+	case "before":
+		return !artwork.Published.IsZero() && artwork.Published.Before(t.date)
+	}
+
+	if contains(artwork.Title) || contains(description()) {
+		return true
+	}
+	for _, tag := range artwork.Tags {
+		if contains(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchResult is an artwork matching a query, with its assets.
+type SearchResult struct {
+	Artwork ArtworkRecord
+	Assets  []AssetRecord
+}
+
+// Search returns the artworks in the catalog matching the query,
+// newest first.
+func (c *Catalog) Search(q *Query) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+
+	err := c.ForEachArtwork(func(artwork ArtworkRecord, assets []AssetRecord) error {
+		if q.Match(&artwork) {
+			results = append(results, SearchResult{Artwork: artwork, Assets: assets})
+		}
+		return nil
+	})
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Artwork.Published.After(results[j].Artwork.Published)
+	})
+
+	return results, err
+}
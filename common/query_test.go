@@ -0,0 +1,99 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryMatch(t *testing.T) {
+	// Arrange
+	artwork := ArtworkRecord{
+		Site:        "artstation",
+		User:        "one",
+		Title:       "Red Dragon",
+		Description: "<p>Painted for a <b>book</b> cover</p>",
+		Tags:        []string{"Concept Art", "creature"},
+		Published:   time.Date(2019, 7, 19, 0, 0, 0, 0, time.UTC),
+	}
+	cases := []struct {
+		query    string
+		expected bool
+	}{
+		{"", true},
+		{"dragon", true},
+		{"DRAGON tag:creature site:artstation", true},
+		{`tag:"concept art"`, true},
+		{"tag:concept", false},
+		{"book cover", true},
+		{"desc:dragon", false},
+		{"title:red artist:one", true},
+		{"user:two", false},
+		{"after:2019-01-01 before:2020", true},
+		{"after:2019-07-20", false},
+		{"-tag:creature", false},
+		{"dragon -sketch", true},
+	}
+
+	for _, c := range cases {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Act
+		actual := q.Match(&artwork)
+
+		// Assert
+		if actual != c.expected {
+			t.Fatalf("Expected %t for '%s', actual %t", c.expected, c.query, actual)
+		}
+	}
+}
+
+func TestParseQueryInvalid(t *testing.T) {
+	for _, text := range []string{`tag:"concept`, "after:yesterday"} {
+		if _, err := ParseQuery(text); err == nil {
+			t.Fatalf("Expected error for '%s'", text)
+		}
+	}
+}
+
+func TestCatalogSearch(t *testing.T) {
+	// Arrange
+	catalog, err := OpenCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	assets := []Asset{
+		{URL: "https://example.com/a.jpg", Site: "artstation", User: "one", ArtworkID: "1", Title: "Dragon", Published: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{URL: "https://example.com/b.jpg", Site: "artstation", User: "one", ArtworkID: "2", Title: "Dragon Rider", Published: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{URL: "https://example.com/c.jpg", Site: "deviantart", User: "two", Title: "Knight"},
+	}
+	for i := range assets {
+		if err := catalog.Seen(&assets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := ParseQuery("dragon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	results, err := catalog.Search(q)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(results))
+	}
+	if results[0].Artwork.Title != "Dragon Rider" {
+		t.Fatalf("Expected %s, actual %s", "Dragon Rider", results[0].Artwork.Title)
+	}
+	if len(results[0].Assets) != 1 || results[0].Assets[0].URL != assets[1].URL {
+		t.Fatalf("Expected assets of the artwork, actual %+v", results[0].Assets)
+	}
+}
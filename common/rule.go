@@ -11,6 +11,7 @@ const (
 // RuleResolver maps URLs to factory functions for scrapers.
 type RuleResolver struct {
 	entries []RuleEntry
+	session *Session
 }
 
 // NewRuleResolver creates a new `RuleResolver`
@@ -25,6 +26,11 @@ func (resolver *RuleResolver) SetMappings(entries ...RuleEntry) {
 	resolver.entries = entries
 }
 
+// SetSession sets the run state passed to scraper factories.
+func (resolver *RuleResolver) SetSession(session *Session) {
+	resolver.session = session
+}
+
 // Resolve takes multiple URLs and matches them with its rule
 // mappings. Each matched rule results in an instance of a scraper.
 //
@@ -34,6 +40,10 @@ func (resolver *RuleResolver) Resolve(seedURLs []string) []ScraperEntry {
 	scrapers := make(map[string]ScraperEntry)
 	nextID := 1
 
+	// Keep the order of the mappings, since map
+	// iteration order is random.
+	names := make([]string, 0)
+
 	for _, rule := range resolver.entries {
 		ruleMatches := make([]RuleMatch, 0)
 
@@ -66,18 +76,20 @@ func (resolver *RuleResolver) Resolve(seedURLs []string) []ScraperEntry {
 			entry, ok := scrapers[rule.name]
 
 			if !ok {
-				entry = ScraperEntry{Scraper: rule.factory(nextID, nil), Seeds: ruleMatches}
+				entry = ScraperEntry{Scraper: rule.factory(nextID, resolver.session), Seeds: ruleMatches}
 				scrapers[rule.name] = entry
+				names = append(names, rule.name)
 				nextID++
 			} else {
 				entry.Seeds = append(entry.Seeds, ruleMatches...)
+				scrapers[rule.name] = entry
 			}
 		}
 	}
 
 	result := make([]ScraperEntry, 0)
-	for _, entry := range scrapers {
-		result = append(result, entry)
+	for _, name := range names {
+		result = append(result, scrapers[name])
 	}
 
 	return result
@@ -94,8 +106,8 @@ type RuleEntry struct {
 
 // RuleFactoryFunc is factory function that is expected to
 // create an instance of a `Scraper`, given the parameters
-// in the rule match and config.
-type RuleFactoryFunc func(id int, config *Config) Scraper
+// in the rule match and the session of the run.
+type RuleFactoryFunc func(id int, session *Session) Scraper
 
 // MapRule is a helper for creating a `RuleEntry`.
 //
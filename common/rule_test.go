@@ -26,7 +26,7 @@ type result struct {
 func TestResolve(t *testing.T) {
 	// Arrange
 	results := make([]result, 0)
-	var f RuleFactoryFunc = func(id int, config *Config) Scraper {
+	var f RuleFactoryFunc = func(id int, session *Session) Scraper {
 		return &noopScraper{
 			runCallback: func(matches []RuleMatch) {
 				for _, match := range matches {
@@ -83,3 +83,38 @@ func TestResolve(t *testing.T) {
 	assertInt(2, results[2].ID)
 	assertStr("three", results[2].Match.UserInfo)
 }
+
+func TestResolveMergesRulesOfScraper(t *testing.T) {
+	// Arrange
+	var f RuleFactoryFunc = func(id int, session *Session) Scraper {
+		return &noopScraper{}
+	}
+	resolver := NewRuleResolver()
+	resolver.SetMappings(
+		MapRule(`www\.deviantart\.com/(?P<userinfo>[a-zA-Z0-9_-]+)`, "deviantart", f),
+		MapRule(`www\.artstation\.com/(?P<userinfo>[a-zA-Z0-9_-]+)`, "artstation", f),
+		MapRule(`(?P<userinfo>[a-zA-Z0-9_-]+)\.deviantart\.com$`, "deviantart", f),
+	)
+	urls := []string{
+		"https://www.deviantart.com/one",
+		"https://www.artstation.com/two",
+		"https://three.deviantart.com",
+	}
+
+	// Act
+	scrapers := resolver.Resolve(urls)
+
+	// Assert
+	if len(scrapers) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(scrapers))
+	}
+	if len(scrapers[0].Seeds) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(scrapers[0].Seeds))
+	}
+	if scrapers[0].Seeds[1].UserInfo != "three" {
+		t.Fatalf("Expected %s, actual %s", "three", scrapers[0].Seeds[1].UserInfo)
+	}
+	if scrapers[1].Seeds[0].UserInfo != "two" {
+		t.Fatalf("Expected %s, actual %s", "two", scrapers[1].Seeds[0].UserInfo)
+	}
+}
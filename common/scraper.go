@@ -13,6 +13,7 @@ type Scraper interface {
 
 // BaseScraper contains useful, commonly used fields.
 type BaseScraper struct {
-	ID     int
-	Config *Config
+	ID      int
+	Config  *Config
+	Session *Session
 }
@@ -0,0 +1,596 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session holds the state shared by all scrapers during a run.
+type Session struct {
+	Config   *Config
+	Manifest *Manifest
+	Catalog  *Catalog
+	Guard    *DiskGuard
+	Storage  Storage
+
+	// chains holds the processor chain of each site,
+	// with the default chain under the empty name.
+	chains map[string]*ProcessorChain
+
+	// clients holds the HTTP client of each site,
+	// with the default client under the empty name.
+	clients map[string]*http.Client
+
+	// templates holds the parsed path template of each site,
+	// with the default template under the empty name.
+	templates map[string]*PathTemplate
+
+	// layouts caches the parsed layouts given by scrapers, used
+	// when no template is configured.
+	layouts   map[string]*PathTemplate
+	layoutsMu sync.Mutex
+
+	// reserved holds the bytes set aside for downloads in flight,
+	// under "<site>/<user>" for galleries and "<site>/" for sites.
+	reserved   map[string]int64
+	quotaMu    sync.Mutex
+	quotaFreed *sync.Cond
+
+	sidecars *sidecarWriter
+	exporter *Exporter
+	planner  *planner
+	mirror   *mirror
+
+	// adoptions are the files adopted from an existing archive
+	// that weren't matched to assets yet.
+	adoptions *adoptions
+}
+
+// NewSession creates a session for the output directory in the
+// config, loading the manifest and catalog of previous runs.
+//
+// Streamed and exporting runs are one-off, so they start with an
+// empty manifest that isn't saved, and without a catalog. Dry runs
+// read the manifest and catalog, but never write them.
+func NewSession(config *Config) (*Session, error) {
+	if config.Export != "" && config.Tar != "" {
+		return nil, fmt.Errorf("can't export and stream a tar archive at once")
+	}
+	if config.DryRun && (config.Export != "" || config.Tar != "") {
+		return nil, fmt.Errorf("dry runs can't export or stream a tar archive")
+	}
+	if config.Mirror && (config.Export != "" || config.Tar != "") {
+		return nil, fmt.Errorf("mirrored runs can't export or stream a tar archive")
+	}
+	if config.Adopt && (config.Export != "" || config.Tar != "" || config.DryRun) {
+		return nil, fmt.Errorf("adopting runs can't export, stream a tar archive or be dry runs")
+	}
+	if config.Sidecar != "" && (config.Archive != "" || config.Tar != "") {
+		// Sidecars would be stored as entries, or pages, of the archive
+		return nil, fmt.Errorf("sidecars can't be written into an archive or tar stream")
+	}
+
+	var mirrored *mirror
+	if config.Mirror {
+		mirrored = newMirror()
+	}
+
+	var exporter *Exporter
+	if config.Export != "" {
+		var err error
+		if exporter, err = NewExporter(config.Export, config.Directory, os.Stdout); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := NewManifest()
+	var catalog *Catalog
+	var plans *planner
+	var adopted *adoptions
+	switch {
+	case config.DryRun:
+		var err error
+		if manifest, err = LoadManifest(config.Directory); err != nil {
+			return nil, err
+		}
+		if catalog, err = OpenCatalogReadOnly(config.Directory); err != nil && err != ErrNotExist {
+			return nil, err
+		}
+		plans = newPlanner(os.Stdout)
+
+	case config.Tar == "" && config.Export == "":
+		var err error
+		if manifest, err = LoadManifest(config.Directory); err != nil {
+			return nil, err
+		}
+		if catalog, err = OpenCatalog(config.Directory); err != nil {
+			return nil, err
+		}
+		adopted = newAdoptions(manifest)
+	}
+
+	storage, err := OpenStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecars, err := newSidecarWriter(config.Sidecar, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make(map[string]*http.Client)
+	templates := make(map[string]*PathTemplate)
+
+	defaults := config.Site("")
+	if defaults.Template != "" {
+		t, err := ParsePathTemplate(defaults.Template)
+		if err != nil {
+			return nil, err
+		}
+		templates[""] = t
+	}
+
+	client, err := NewHTTPClient(defaults.Proxy, defaults.Header())
+	if err != nil {
+		return nil, err
+	}
+	clients[""] = client
+
+	for name := range config.Sites {
+		site := config.Site(name)
+		if site.Template != "" {
+			t, err := ParsePathTemplate(site.Template)
+			if err != nil {
+				return nil, fmt.Errorf("site '%s': %s", name, err)
+			}
+			templates[name] = t
+		}
+
+		client, err := NewHTTPClient(site.Proxy, site.Header())
+		if err != nil {
+			return nil, fmt.Errorf("site '%s': %s", name, err)
+		}
+		clients[name] = client
+	}
+
+	session := &Session{
+		Config:   config,
+		Manifest: manifest,
+		Catalog:  catalog,
+		Guard:    NewDiskGuard(config.Directory, config.MinFreeSpace, config.PauseOnLowSpace),
+		Storage:  storage,
+		chains:   make(map[string]*ProcessorChain),
+		clients:  clients,
+		sidecars: sidecars,
+		exporter: exporter,
+		planner:  plans,
+		mirror:   mirrored,
+
+		templates: templates,
+		layouts:   make(map[string]*PathTemplate),
+		adoptions: adopted,
+		reserved:  make(map[string]int64),
+	}
+	session.quotaFreed = sync.NewCond(&session.quotaMu)
+
+	return session, nil
+}
+
+// Client returns the HTTP client for requests to the named site,
+// which applies the site's proxy and header settings. Scrapers
+// must use it for every request they make.
+func (s *Session) Client(site string) *http.Client {
+	if client, ok := s.clients[site]; ok {
+		return client
+	}
+	return s.clients[""]
+}
+
+// SetProcessors creates the processor chains configured for each
+// site, using the factories in the given mappings.
+//
+// Processors work on local files, so they can't be used with
+// other storages.
+func (s *Session) SetProcessors(entries ...ProcessorEntry) error {
+	_, local := s.Storage.(FileStorage)
+
+	chain, err := NewProcessorChain(s, s.Config.Processors, entries)
+	if err != nil {
+		return err
+	}
+	if chain.Len() > 0 && !local {
+		return fmt.Errorf("processors require local storage")
+	}
+	s.chains[""] = chain
+
+	for name := range s.Config.Sites {
+		chain, err := NewProcessorChain(s, s.Config.Site(name).Processors, entries)
+		if err != nil {
+			return fmt.Errorf("site '%s': %s", name, err)
+		}
+		if chain.Len() > 0 && !local {
+			return fmt.Errorf("site '%s': processors require local storage", name)
+		}
+		s.chains[name] = chain
+	}
+
+	return nil
+}
+
+// chain returns the processor chain for the named site.
+func (s *Session) chain(site string) *ProcessorChain {
+	if chain, ok := s.chains[site]; ok {
+		return chain
+	}
+	return s.chains[""]
+}
+
+// Download fetches the asset into the storage, runs the site's
+// processors over it, and records it in the manifest and catalog.
+// The asset is recorded in the catalog as seen even when it's
+// skipped.
+//
+// The file is stored where the site's configured template lays
+// it out, or else where the scraper's default layout does. See
+// `PathTemplate`.
+//
+// A failed processor is reported, but doesn't fail the download.
+// The file is recorded as it was after the last successful
+// processor. The same goes for sidecars, when enabled.
+//
+// Assets are skipped when a previous run already downloaded them,
+// when they're filtered out or not in the URLs the config limits
+// downloads to, or when the gallery or site has reached its quota.
+//
+// When exporting, the asset is written to the export instead, and
+// nothing is downloaded. Dry runs print the asset instead.
+//
+// Mirrored runs remember that the asset is still listed. See
+// `Listed`.
+//
+// Returns the storage key of the file.
+func (s *Session) Download(asset *Asset, layout string) (string, error) {
+	if s.mirror != nil {
+		s.mirror.see(asset)
+	}
+
+	if s.exporter != nil {
+		key, err := s.assetKey(asset, layout)
+		if err != nil {
+			return "", err
+		}
+		return key, s.exporter.Export(asset, key)
+	}
+
+	if s.planner != nil {
+		return s.plan(asset, layout)
+	}
+
+	if len(s.Config.URLs) > 0 && !s.Config.URLs[asset.URL] {
+		return "", &SkipError{URL: asset.URL, Reason: "not in the listed URLs"}
+	}
+
+	if err := s.Catalog.Seen(asset); err != nil {
+		log.Println("Warning: Failed to update catalog:", err)
+	}
+
+	if err := s.checkDownloaded(asset); err != nil {
+		return "", err
+	}
+
+	if s.Config.Adopt {
+		return "", &SkipError{URL: asset.URL, Reason: "not in the archive"}
+	}
+
+	reservation, err := s.reserveQuota(asset)
+	if err != nil {
+		return "", err
+	}
+	defer s.releaseQuota(reservation)
+
+	checksum := sha256.New()
+	options := DownloadOptions{
+		Storage:   s.Storage,
+		Overwrite: true,
+		Filter:    &s.Config.Filter,
+		Guard:     s.Guard,
+		Client:    s.Client(asset.Site),
+		Hash:      checksum,
+	}
+
+	key, err := s.assetKey(asset, layout)
+	if err != nil {
+		return "", err
+	}
+
+	key, err = DownloadFile(asset, key, options)
+	if err != nil {
+		if s.mirror != nil && errors.Is(err, ErrDiskSpace) {
+			s.mirror.stop()
+		}
+		return "", err
+	}
+
+	downloaded := key
+	hash := hex.EncodeToString(checksum.Sum(nil))
+
+	if storage, ok := s.Storage.(FileStorage); ok {
+		chain := s.chain(asset.Site)
+		fp, err := chain.Run(storage.LocalPath(key), asset)
+		if err != nil {
+			log.Println("Warning:", err)
+		}
+		key = s.relativePath(fp)
+
+		// Processors may have changed the file, which is on
+		// the local disk, so it's cheap to hash again.
+		if chain.Len() > 0 {
+			checksum.Reset()
+			hash = ""
+			if err := hashLocalFile(checksum, fp); err != nil {
+				log.Println("Warning: Failed to hash file:", err)
+			} else {
+				hash = hex.EncodeToString(checksum.Sum(nil))
+			}
+		}
+	}
+
+	if err := s.record(asset, key, downloaded, hash); err != nil {
+		return key, err
+	}
+
+	if s.Config.Sidecar != "" {
+		entry, _ := s.Manifest.Get(key)
+		if err := s.sidecars.Write(asset, key, entry.Size); err != nil {
+			log.Println("Warning:", err)
+		}
+	}
+
+	return key, nil
+}
+
+// assetKey lays out the storage key of the asset, using the
+// site's template or the given default layout.
+func (s *Session) assetKey(asset *Asset, layout string) (string, error) {
+	t, ok := s.templates[asset.Site]
+	if !ok {
+		t, ok = s.templates[""]
+	}
+
+	if !ok {
+		s.layoutsMu.Lock()
+		t, ok = s.layouts[layout]
+		if !ok {
+			var err error
+			if t, err = ParsePathTemplate(layout); err != nil {
+				s.layoutsMu.Unlock()
+				return "", err
+			}
+			s.layouts[layout] = t
+		}
+		s.layoutsMu.Unlock()
+	}
+
+	return t.Execute(asset)
+}
+
+// Close writes the remaining sidecars and export, finishes writing
+// to the storage, saves the manifest and closes the catalog. Dry
+// runs print their totals instead.
+//
+// Mirrored runs first remove the files no longer listed upstream,
+// so scrapers must be done.
+func (s *Session) Close() error {
+	defer s.Catalog.Close()
+
+	if s.mirror != nil {
+		if err := s.applyMirror(); err != nil {
+			return err
+		}
+	}
+
+	if s.planner != nil {
+		s.planner.Summary()
+		return nil
+	}
+
+	if err := s.exporter.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.sidecars.Flush(); err != nil {
+		return err
+	}
+
+	if closer, ok := s.Storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return s.Manifest.Save()
+}
+
+// plan prints where the asset would be stored, and whether it's
+// already there or filtered out by what is known about it so far.
+func (s *Session) plan(asset *Asset, layout string) (string, error) {
+	key, err := s.assetKey(asset, layout)
+	if err != nil {
+		return "", err
+	}
+
+	status := planNew
+	if err := s.checkDownloaded(asset); IsSkipped(err) {
+		status = planExists
+	} else if exists, _ := s.Storage.Exists(key); exists {
+		status = planExists
+	} else if err := s.Config.Filter.Check(asset); err != nil {
+		status = planFiltered
+	}
+
+	s.planner.Plan(asset, key, status)
+
+	return key, nil
+}
+
+// checkDownloaded skips the asset if the catalog or manifest shows
+// it was downloaded before, and the file is still there. The file
+// may have been converted or moved by processors since.
+func (s *Session) checkDownloaded(asset *Asset) error {
+	if s.Config.Force {
+		return nil
+	}
+
+	entry, ok := s.Manifest.FindURL(asset.URL)
+	if ok && entry.DuplicateOf != "" {
+		return &SkipError{URL: asset.URL, Reason: fmt.Sprintf("duplicate of '%s'", entry.DuplicateOf)}
+	}
+
+	// The catalog knows where the file is now, while
+	// archives from before it only have the manifest.
+	key := entry.Path
+	if record, found := s.Catalog.FindURL(asset.URL); found && record.Path != "" {
+		key = record.Path
+	}
+	if key == "" {
+		return s.checkAdopted(asset)
+	}
+
+	if exists, err := s.Storage.Exists(key); err != nil || !exists {
+		return nil
+	}
+
+	return &SkipError{URL: asset.URL, Reason: fmt.Sprintf("already downloaded to '%s'", key)}
+}
+
+// quotaReservation holds the bytes a download set aside under
+// each quota, keyed like Session.reserved.
+type quotaReservation map[string]int64
+
+// reserveQuota sets aside the size of the asset under its gallery
+// and site quotas while it downloads, so concurrent downloads can't
+// overshoot them together. The asset is skipped if it wouldn't fit
+// even once the other downloads are done, otherwise it waits for
+// them. An asset may fill a quota exactly.
+//
+// When the size of the asset isn't known, it reserves the rest of
+// the quota, so it downloads alone. It's only skipped once the quota
+// is used up, so it may overshoot by its own size.
+//
+// The reservation must be released once the download is recorded,
+// or has failed.
+func (s *Session) reserveQuota(asset *Asset) (quotaReservation, error) {
+	site := s.Config.Site(asset.Site)
+	quotas := []struct {
+		name  string
+		user  string
+		quota ByteSize
+	}{
+		{"gallery", asset.User, site.GalleryQuota},
+		{"site", "", site.Quota},
+	}
+
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	for {
+		reservation := make(quotaReservation)
+		wait := false
+
+		for _, q := range quotas {
+			if q.quota <= 0 {
+				continue
+			}
+
+			usage := s.Manifest.Usage(asset.Site, q.user)
+			size := asset.Size
+			if size <= 0 {
+				size = int64(q.quota) - usage
+			}
+			if size <= 0 || usage+size > int64(q.quota) {
+				return nil, &SkipError{
+					URL:    asset.URL,
+					Reason: fmt.Sprintf("%s quota of %s reached", q.name, FormatByteSize(int64(q.quota))),
+				}
+			}
+
+			key := asset.Site + "/" + q.user
+			if usage+s.reserved[key]+size > int64(q.quota) {
+				wait = true
+			}
+			reservation[key] = size
+		}
+
+		if !wait {
+			for key, size := range reservation {
+				s.reserved[key] += size
+			}
+			return reservation, nil
+		}
+
+		s.quotaFreed.Wait()
+	}
+}
+
+// releaseQuota gives back the bytes set aside for a download, and
+// wakes the downloads waiting on them.
+func (s *Session) releaseQuota(reservation quotaReservation) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	for key, size := range reservation {
+		s.reserved[key] -= size
+	}
+	s.quotaFreed.Broadcast()
+}
+
+// record adds the file to the manifest, along with the key it
+// was originally downloaded to if processors changed it, and to
+// the catalog, along with its content hash.
+func (s *Session) record(asset *Asset, key string, downloaded string, hash string) error {
+	info, err := s.Storage.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	entry := ManifestEntry{
+		Path:       key,
+		URL:        asset.URL,
+		Site:       asset.Site,
+		User:       asset.User,
+		Size:       info.Size,
+		Downloaded: time.Now(),
+	}
+
+	if downloaded != key {
+		entry.Original = downloaded
+	}
+
+	s.Manifest.Add(entry)
+
+	if err := s.Catalog.Stored(asset.URL, key, info.Size, hash); err != nil {
+		log.Println("Warning: Failed to update catalog:", err)
+	}
+
+	return nil
+}
+
+// relativePath converts a file path to the form stored in the
+// manifest, relative to the output directory.
+func (s *Session) relativePath(fp string) string {
+	rel, err := filepath.Rel(s.Config.Directory, fp)
+	if err != nil {
+		return filepath.ToSlash(fp)
+	}
+	return filepath.ToSlash(rel)
+}
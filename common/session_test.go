@@ -0,0 +1,103 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionQuota(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	config := &Config{
+		Directory:    dir,
+		GalleryQuota: 100,
+		Sites: map[string]SiteConfig{
+			"artstation": {GalleryQuota: 1000, Quota: 200},
+		},
+	}
+	session, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Manifest.Add(ManifestEntry{Path: "deviantart/one/a.jpg", Site: "deviantart", User: "one", Size: 100})
+	session.Manifest.Add(ManifestEntry{Path: "artstation/one/p/a.jpg", Site: "artstation", User: "one", Size: 150})
+
+	cases := []struct {
+		asset   Asset
+		skipped bool
+	}{
+		{Asset{Site: "deviantart", User: "one"}, true},
+		{Asset{Site: "deviantart", User: "two", Size: 50}, false},
+		{Asset{Site: "deviantart", User: "two", Size: 150}, true},
+		{Asset{Site: "artstation", User: "two", Size: 10}, false},
+		{Asset{Site: "artstation", User: "two", Size: 60}, true},
+		// Filling a quota exactly is allowed
+		{Asset{Site: "deviantart", User: "two", Size: 100}, false},
+		{Asset{Site: "deviantart", User: "two", Size: 101}, true},
+		{Asset{Site: "artstation", User: "two", Size: 50}, false},
+		{Asset{Site: "artstation", User: "two", Size: 51}, true},
+	}
+
+	for _, c := range cases {
+		// Act
+		reservation, err := session.reserveQuota(&c.asset)
+		session.releaseQuota(reservation)
+
+		// Assert
+		if c.skipped != IsSkipped(err) {
+			t.Fatalf("Asset %+v: expected skipped %t, actual error: %v", c.asset, c.skipped, err)
+		}
+	}
+}
+
+func TestSessionQuotaConcurrent(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write(make([]byte, 40))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		size     int64
+		expected int64
+	}{
+		{40, 80},
+		// Unknown sizes download one at a time, until
+		// the quota is used up.
+		{0, 120},
+	}
+
+	for _, c := range cases {
+		session, err := NewSession(&Config{Directory: t.TempDir(), GalleryQuota: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Act
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				asset := Asset{URL: fmt.Sprintf("%s/%d.jpg", server.URL, i), Site: "deviantart", User: "one", Size: c.size}
+				if _, err := session.Download(&asset, "{site}/{user}/{filename}"); err != nil && !IsSkipped(err) {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Assert
+		if usage := session.Manifest.Usage("deviantart", "one"); usage != c.expected {
+			t.Fatalf("Expected %d, actual %d", c.expected, usage)
+		}
+		if err := session.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SidecarPerFile writes a "<file>.json" next to each file.
+	SidecarPerFile string = "file"
+
+	// SidecarPerProject writes a "metadata.json" in each folder,
+	// describing all the artworks in it.
+	SidecarPerProject string = "project"
+
+	// SidecarSuffix is appended to file names for their sidecars.
+	SidecarSuffix string = ".json"
+
+	// ProjectSidecarFilename is the name of per folder sidecars.
+	ProjectSidecarFilename string = "metadata.json"
+)
+
+// Sidecar is the metadata of an artwork kept next to its files,
+// so other tools can index the archive without scraping again.
+type Sidecar struct {
+	Site        string        `json:"site"`
+	User        string        `json:"user"`
+	ArtworkID   string        `json:"artwork_id,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	PageURL     string        `json:"page_url,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	Published   *time.Time    `json:"published,omitempty"`
+	Files       []SidecarFile `json:"files"`
+
+	// Source is the raw metadata the site gave for the artwork
+	Source json.RawMessage `json:"source,omitempty"`
+}
+
+// SidecarFile describes a downloaded file of an artwork.
+type SidecarFile struct {
+	Path        string `json:"path"`
+	URL         string `json:"url"`
+	Index       int    `json:"index,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// projectSidecar is the format of per folder sidecars.
+type projectSidecar struct {
+	Artworks []*Sidecar `json:"artworks"`
+}
+
+// NewSidecar describes the asset stored under the key.
+func NewSidecar(asset *Asset, key string, size int64) *Sidecar {
+	sidecar := &Sidecar{
+		Site:        asset.Site,
+		User:        asset.User,
+		ArtworkID:   asset.ArtworkID,
+		Title:       asset.Title,
+		Description: asset.Description,
+		PageURL:     asset.PageURL,
+		Tags:        asset.Tags,
+		Source:      asset.Source,
+	}
+
+	if !asset.Published.IsZero() {
+		published := asset.Published
+		sidecar.Published = &published
+	}
+
+	sidecar.Files = []SidecarFile{{
+		Path:        key,
+		URL:         asset.URL,
+		Index:       asset.Index,
+		Width:       asset.Width,
+		Height:      asset.Height,
+		Size:        size,
+		ContentType: asset.ContentType,
+	}}
+
+	return sidecar
+}
+
+// artworkKey identifies the artwork a sidecar describes.
+func (s *Sidecar) artworkKey() string {
+	switch {
+	case s.ArtworkID != "":
+		return s.ArtworkID
+	case s.PageURL != "":
+		return s.PageURL
+	}
+	return s.Title
+}
+
+// merge adds the files of another sidecar of the same artwork,
+// taking its newer metadata.
+func (s *Sidecar) merge(other *Sidecar) {
+	files := make(map[string]SidecarFile)
+	for _, f := range s.Files {
+		files[f.Path] = f
+	}
+	for _, f := range other.Files {
+		files[f.Path] = f
+	}
+
+	*s = *other
+	s.Files = make([]SidecarFile, 0, len(files))
+	for _, f := range files {
+		s.Files = append(s.Files, f)
+	}
+
+	sort.Slice(s.Files, func(i, j int) bool {
+		if s.Files[i].Index != s.Files[j].Index {
+			return s.Files[i].Index < s.Files[j].Index
+		}
+		return s.Files[i].Path < s.Files[j].Path
+	})
+}
+
+// sidecarWriter writes sidecars of downloaded assets to the storage.
+//
+// Per folder sidecars are gathered during the run and written
+// when the writer is flushed, merged with what previous runs
+// wrote, if the storage can be read.
+type sidecarWriter struct {
+	mode    string
+	storage Storage
+
+	// folders holds the artworks of each folder,
+	// by artwork key, for per folder sidecars.
+	folders map[string]map[string]*Sidecar
+	lock    *sync.Mutex // pointer to avoid copy
+}
+
+func newSidecarWriter(mode string, storage Storage) (*sidecarWriter, error) {
+	if mode != "" && mode != SidecarPerFile && mode != SidecarPerProject {
+		return nil, fmt.Errorf("unsupported sidecar mode '%s', expected %s or %s", mode, SidecarPerFile, SidecarPerProject)
+	}
+
+	return &sidecarWriter{
+		mode:    mode,
+		storage: storage,
+		folders: make(map[string]map[string]*Sidecar),
+		lock:    &sync.Mutex{},
+	}, nil
+}
+
+// Write describes the asset stored under the key.
+func (w *sidecarWriter) Write(asset *Asset, key string, size int64) error {
+	sidecar := NewSidecar(asset, key, size)
+
+	switch w.mode {
+	case SidecarPerFile:
+		return w.put(key+SidecarSuffix, sidecar)
+
+	case SidecarPerProject:
+		w.lock.Lock()
+		defer w.lock.Unlock()
+
+		folder := path.Dir(key)
+		if w.folders[folder] == nil {
+			w.folders[folder] = make(map[string]*Sidecar)
+		}
+
+		if existing, ok := w.folders[folder][sidecar.artworkKey()]; ok {
+			existing.merge(sidecar)
+		} else {
+			w.folders[folder][sidecar.artworkKey()] = sidecar
+		}
+	}
+
+	return nil
+}
+
+// Flush writes the per folder sidecars.
+func (w *sidecarWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for folder, artworks := range w.folders {
+		if err := w.update(folder, artworks); err != nil {
+			return err
+		}
+	}
+
+	w.folders = make(map[string]map[string]*Sidecar)
+
+	return nil
+}
+
+// update merges the artworks, by artwork key, into the sidecar
+// of the folder.
+func (w *sidecarWriter) update(folder string, artworks map[string]*Sidecar) error {
+	key := JoinKey(folder, ProjectSidecarFilename)
+
+	data := w.read(key)
+	for _, sidecar := range data.Artworks {
+		if current, ok := artworks[sidecar.artworkKey()]; ok {
+			sidecar.merge(current)
+			delete(artworks, sidecar.artworkKey())
+		}
+	}
+	for _, sidecar := range artworks {
+		data.Artworks = append(data.Artworks, sidecar)
+	}
+
+	sort.SliceStable(data.Artworks, func(i, j int) bool {
+		return data.Artworks[i].artworkKey() < data.Artworks[j].artworkKey()
+	})
+
+	return w.put(key, data)
+}
+
+// read loads a per folder sidecar written by a previous run.
+// Returns an empty sidecar if there is none, or it can't be read.
+func (w *sidecarWriter) read(key string) *projectSidecar {
+	data := &projectSidecar{}
+
+	storage, ok := w.storage.(ReadableStorage)
+	if !ok {
+		return data
+	}
+
+	r, err := storage.Open(key)
+	if err != nil {
+		return data
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(data); err != nil {
+		return &projectSidecar{}
+	}
+
+	return data
+}
+
+func (w *sidecarWriter) put(key string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := w.storage.Put(key, bytes.NewReader(b), time.Time{}); err != nil {
+		return fmt.Errorf("failed to write sidecar '%s': %s", key, err)
+	}
+
+	return nil
+}
+
+// MoveProjectSidecars updates the per folder sidecars in the
+// storage after files were moved, given the new key of each old
+// key. The entries of moved files go to the sidecar of their new
+// folder, and are taken out of the old one unless keep is set, eg.
+// when the files were linked. Sidecars left without files are
+// deleted.
+//
+// Files already moved are no longer in their old sidecar, so an
+// interrupted update can be repeated.
+func MoveProjectSidecars(storage ReadableStorage, paths map[string]string, keep bool) error {
+	w := &sidecarWriter{mode: SidecarPerProject, storage: storage}
+
+	folders := make([]string, 0)
+	seen := make(map[string]bool)
+	for from := range paths {
+		if folder := path.Dir(from); !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
+
+	for _, folder := range folders {
+		key := JoinKey(folder, ProjectSidecarFilename)
+		exists, err := storage.Exists(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		data := w.read(key)
+		remaining := make([]*Sidecar, 0, len(data.Artworks))
+
+		// Artworks of the moved files, by new folder and artwork key
+		moved := make(map[string]map[string]*Sidecar)
+
+		for _, sidecar := range data.Artworks {
+			files := make([]SidecarFile, 0, len(sidecar.Files))
+
+			for _, file := range sidecar.Files {
+				to, ok := paths[file.Path]
+				if !ok || keep {
+					files = append(files, file)
+				}
+				if !ok {
+					continue
+				}
+
+				target := path.Dir(to)
+				if moved[target] == nil {
+					moved[target] = make(map[string]*Sidecar)
+				}
+
+				file.Path = to
+				artwork := *sidecar
+				artwork.Files = []SidecarFile{file}
+				if existing, ok := moved[target][artwork.artworkKey()]; ok {
+					existing.merge(&artwork)
+				} else {
+					moved[target][artwork.artworkKey()] = &artwork
+				}
+			}
+
+			if len(files) > 0 {
+				sidecar.Files = files
+				remaining = append(remaining, sidecar)
+			}
+		}
+
+		if len(moved) == 0 {
+			continue
+		}
+
+		// Files renamed within the folder stay in its sidecar
+		if artworks, ok := moved[folder]; ok {
+			for _, sidecar := range remaining {
+				if artwork, ok := artworks[sidecar.artworkKey()]; ok {
+					sidecar.merge(artwork)
+					delete(artworks, sidecar.artworkKey())
+				}
+			}
+			for _, artwork := range artworks {
+				remaining = append(remaining, artwork)
+			}
+			delete(moved, folder)
+		}
+
+		// New sidecars are written before the old one is changed,
+		// so an interruption loses no entries.
+		for target, artworks := range moved {
+			if err := w.update(target, artworks); err != nil {
+				return err
+			}
+		}
+
+		if len(remaining) == 0 {
+			if err := storage.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data.Artworks = remaining
+		sort.SliceStable(data.Artworks, func(i, j int) bool {
+			return data.Artworks[i].artworkKey() < data.Artworks[j].artworkKey()
+		})
+		if err := w.put(key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveFileSidecars updates the per file sidecars in the storage
+// after files were moved along with their sidecars, given the new
+// key of each old key. Sidecars are rewritten rather than changed
+// in place, so linked sidecars keep their old paths.
+//
+// Files already updated no longer have their old path, so an
+// interrupted update can be repeated.
+func MoveFileSidecars(storage ReadableStorage, paths map[string]string) error {
+	w := &sidecarWriter{mode: SidecarPerFile, storage: storage}
+
+	keys := make([]string, 0, len(paths))
+	for from := range paths {
+		keys = append(keys, from)
+	}
+	sort.Strings(keys)
+
+	for _, from := range keys {
+		key := paths[from] + SidecarSuffix
+
+		r, err := storage.Open(key)
+		if err == ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		sidecar := &Sidecar{}
+		err = json.NewDecoder(r).Decode(sidecar)
+		r.Close()
+		if err != nil {
+			// Left as it is, like sidecars that can't be loaded
+			continue
+		}
+
+		changed := false
+		for i := range sidecar.Files {
+			if sidecar.Files[i].Path == from {
+				sidecar.Files[i].Path = paths[from]
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if err := w.put(key, sidecar); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadSidecars reads the sidecars in an output directory, both
+// per file and per folder ones. Sidecars that can't be parsed
+// are skipped.
+func LoadSidecars(directory string) ([]*Sidecar, error) {
+	result := make([]*Sidecar, 0)
+
+	err := WalkArchive(directory, func(fp string, info os.FileInfo) error {
+		if !strings.HasSuffix(fp, SidecarSuffix) {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+
+		if filepath.Base(fp) == ProjectSidecarFilename {
+			var data projectSidecar
+			if err := json.Unmarshal(b, &data); err == nil {
+				result = append(result, data.Artworks...)
+			}
+			return nil
+		}
+
+		// Only the sidecars of files, not other JSON files
+		if _, err := os.Stat(strings.TrimSuffix(fp, SidecarSuffix)); err != nil {
+			return nil
+		}
+
+		var sidecar Sidecar
+		if err := json.Unmarshal(b, &sidecar); err == nil {
+			result = append(result, &sidecar)
+		}
+
+		return nil
+	})
+
+	return result, err
+}
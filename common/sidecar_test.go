@@ -0,0 +1,161 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSidecarPerProject(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	session, err := NewSession(&Config{Directory: t.TempDir(), Storage: "memory", Sidecar: SidecarPerProject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := session.Storage.(*MemoryStorage)
+	source := json.RawMessage(`{"id":42}`)
+	assets := []Asset{
+		{URL: server.URL + "/b.jpg", Site: "artstation", User: "one", ArtworkID: "42", Index: 2, Title: "Dragon", Source: source},
+		{URL: server.URL + "/a.jpg", Site: "artstation", User: "one", ArtworkID: "42", Index: 1, Title: "Dragon", Source: source},
+	}
+
+	// Act
+	for i := range assets {
+		if _, err := session.Download(&assets[i], "{site}/{user}/{filename}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	r, err := storage.Open("artstation/one/metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var data projectSidecar
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Artworks) != 1 {
+		t.Fatalf("Expected %d, actual %d", 1, len(data.Artworks))
+	}
+	artwork := data.Artworks[0]
+	if len(artwork.Files) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(artwork.Files))
+	}
+	if artwork.Files[0].Path != "artstation/one/a.jpg" {
+		t.Fatalf("Expected %s, actual %s", "artstation/one/a.jpg", artwork.Files[0].Path)
+	}
+	if artwork.Files[0].Size != 4 {
+		t.Fatalf("Expected %d, actual %d", 4, artwork.Files[0].Size)
+	}
+	var id struct{ ID int }
+	if err := json.Unmarshal(artwork.Source, &id); err != nil || id.ID != 42 {
+		t.Fatalf("Expected source %s, actual %s", source, artwork.Source)
+	}
+}
+
+func TestSidecarPerFile(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	session, err := NewSession(&Config{Directory: t.TempDir(), Storage: "memory", Sidecar: SidecarPerFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := session.Storage.(*MemoryStorage)
+	asset := Asset{URL: server.URL + "/a.jpg", Site: "deviantart", User: "one", Title: "Dragon", Tags: []string{"concept"}}
+
+	// Act
+	key, err := session.Download(&asset, "{site}/{user}/{filename}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	r, err := storage.Open(key + SidecarSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var sidecar Sidecar
+	if err := json.NewDecoder(r).Decode(&sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar.Title != "Dragon" {
+		t.Fatalf("Expected %s, actual %s", "Dragon", sidecar.Title)
+	}
+	if len(sidecar.Tags) != 1 || sidecar.Tags[0] != "concept" {
+		t.Fatalf("Expected %v, actual %v", asset.Tags, sidecar.Tags)
+	}
+}
+
+func TestMoveProjectSidecars(t *testing.T) {
+	// Arrange
+	storage := NewMemoryStorage()
+	w, err := newSidecarWriter(SidecarPerProject, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a.jpg", "b.jpg"} {
+		asset := Asset{URL: "https://example.com/" + name, Site: "artstation", User: "one", ArtworkID: "42", Index: i + 1}
+		if err := w.Write(&asset, "artstation/one/"+name, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	err = MoveProjectSidecars(storage, map[string]string{"artstation/one/a.jpg": "artstation/one/2019/a.jpg"}, false)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved := w.read("artstation/one/2019/metadata.json")
+	if len(moved.Artworks) != 1 || len(moved.Artworks[0].Files) != 1 {
+		t.Fatalf("Expected one moved file, actual %+v", moved.Artworks)
+	}
+	if moved.Artworks[0].Files[0].Path != "artstation/one/2019/a.jpg" || moved.Artworks[0].ArtworkID != "42" {
+		t.Fatalf("Expected %s of artwork 42, actual %+v", "artstation/one/2019/a.jpg", moved.Artworks[0])
+	}
+
+	kept := w.read("artstation/one/metadata.json")
+	if len(kept.Artworks) != 1 || len(kept.Artworks[0].Files) != 1 {
+		t.Fatalf("Expected one file left, actual %+v", kept.Artworks)
+	}
+	if kept.Artworks[0].Files[0].Path != "artstation/one/b.jpg" {
+		t.Fatalf("Expected %s, actual %s", "artstation/one/b.jpg", kept.Artworks[0].Files[0].Path)
+	}
+}
+
+func TestSidecarWithArchive(t *testing.T) {
+	configs := []Config{
+		{Directory: t.TempDir(), Archive: "cbz", Sidecar: SidecarPerFile},
+		{Directory: t.TempDir(), Archive: "zip", Sidecar: SidecarPerProject},
+		{Directory: t.TempDir(), Tar: "-", Sidecar: SidecarPerFile},
+	}
+
+	for _, config := range configs {
+		// Act
+		_, err := NewSession(&config)
+
+		// Assert
+		if err == nil {
+			t.Fatalf("Expected sidecars with archive '%s', tar '%s' to fail", config.Archive, config.Tar)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotExist is returned by storages when a key doesn't exist.
+var ErrNotExist = errors.New("object does not exist")
+
+// Storage is where downloaded files are kept.
+//
+// Files are identified by keys, which are slash separated
+// paths relative to the root of the archive, for example
+// "deviantart/username/image.jpg".
+type Storage interface {
+	// Put stores the content under the key, replacing any existing
+	// object. Other readers never see a partially written object.
+	// The modification time is kept when not zero.
+	Put(key string, r io.Reader, modTime time.Time) error
+
+	// Exists checks whether an object is stored under the key.
+	Exists(key string) (bool, error)
+
+	// Stat returns information about the object, or `ErrNotExist`.
+	Stat(key string) (ObjectInfo, error)
+
+	// List returns all objects with keys starting with the prefix,
+	// ordered by key.
+	List(prefix string) ([]ObjectInfo, error)
+
+	// Delete removes the object. Deleting a key that doesn't
+	// exist is not an error.
+	Delete(key string) error
+}
+
+// FileStorage is a storage backed by the local file system, where
+// objects can be worked on directly as files.
+type FileStorage interface {
+	Storage
+
+	// LocalPath returns the file path the key is stored at.
+	LocalPath(key string) string
+}
+
+// AssetStorage is a storage that keeps the metadata of assets
+// along with their files.
+type AssetStorage interface {
+	Storage
+
+	// PutAsset stores the downloaded file of the asset.
+	PutAsset(key string, r io.Reader, modTime time.Time, asset *Asset) error
+}
+
+// ReadableStorage is a storage files can be read back from.
+type ReadableStorage interface {
+	Storage
+
+	// Open returns the content of the object, or `ErrNotExist`.
+	Open(key string) (io.ReadCloser, error)
+}
+
+// MemoryBuffered is implemented by storages that keep nothing on
+// the local disk. Downloads for them are buffered in memory instead
+// of in temporary files.
+type MemoryBuffered interface {
+	BufferInMemory() bool
+}
+
+// bufferInMemory checks whether downloads for the storage should
+// be buffered in memory.
+func bufferInMemory(storage Storage) bool {
+	b, ok := storage.(MemoryBuffered)
+	return ok && b.BufferInMemory()
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// OpenStorage creates the storage selected in the config.
+//
+// An empty location stores files in the output directory, or
+// in archives there when an archive format is set. A tar stream
+// takes the place of storage when set, see `OpenTarStorage`.
+// "memory" keeps files in memory, and is lost when the run
+// ends. "s3://bucket/prefix" stores files in an S3 compatible
+// object store, see `NewS3Storage`.
+func OpenStorage(config *Config) (Storage, error) {
+	if config.Tar != "" {
+		if config.Storage != "" || config.Archive != "" {
+			return nil, fmt.Errorf("tar output can't be combined with other storage or archives")
+		}
+		return OpenTarStorage(config.Tar)
+	}
+
+	if config.Archive != "" {
+		if config.Storage != "" {
+			return nil, fmt.Errorf("archive output requires local storage")
+		}
+		return NewArchiveStorage(config.Directory, config.Archive)
+	}
+
+	switch {
+	case config.Storage == "":
+		return NewLocalStorage(config.Directory), nil
+	case config.Storage == "memory":
+		return NewMemoryStorage(), nil
+	case strings.HasPrefix(config.Storage, "s3://"):
+		u, err := url.Parse(config.Storage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage URL: %s", err)
+		}
+		return NewS3Storage(u)
+	}
+
+	return nil, fmt.Errorf("unsupported storage '%s'", config.Storage)
+}
+
+// JoinKey joins path elements into a storage key.
+func JoinKey(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+// LocalStorage keeps objects as files under a root directory.
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage creates a storage in the given directory.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+// LocalPath returns the file path the key is stored at.
+func (s *LocalStorage) LocalPath(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put writes the content to a temporary file next to the
+// destination, then moves it into place.
+func (s *LocalStorage) Put(key string, r io.Reader, modTime time.Time) error {
+	fp := s.LocalPath(key)
+	if err := os.MkdirAll(filepath.Dir(fp), os.ModePerm); err != nil {
+		return err
+	}
+
+	tfp := filepath.Join(filepath.Dir(fp), TempFilename(filepath.Base(fp)))
+
+	// Close file before rename, because Windows locks
+	// the file handle.
+	err := func() error {
+		file, err := os.Create(tfp)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(file, r)
+		return err
+	}()
+
+	if err != nil {
+		_ = os.Remove(tfp)
+		return err
+	}
+
+	return commitFile(tfp, fp, modTime)
+}
+
+// Open opens the file for reading.
+func (s *LocalStorage) Open(key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.LocalPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return file, err
+}
+
+// Exists checks whether the file exists.
+func (s *LocalStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.LocalPath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the size and modification time of the file.
+func (s *LocalStorage) Stat(key string) (ObjectInfo, error) {
+	stat, err := os.Stat(s.LocalPath(key))
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotExist
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// List walks the files in the archive. Hidden files, such
+// as partial downloads and application state, are skipped.
+func (s *LocalStorage) List(prefix string) ([]ObjectInfo, error) {
+	result := make([]ObjectInfo, 0)
+
+	err := WalkArchive(s.root, func(fp string, info os.FileInfo) error {
+		rel, err := filepath.Rel(s.root, fp)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+
+	return result, err
+}
+
+// Delete removes the file.
+func (s *LocalStorage) Delete(key string) error {
+	err := os.Remove(s.LocalPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MemoryStorage keeps objects in memory. Useful for tests.
+type MemoryStorage struct {
+	objects map[string]memoryObject
+	lock    *sync.RWMutex // pointer to avoid copy
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStorage creates an empty in-memory storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		objects: make(map[string]memoryObject),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+// Put reads the whole content before storing it.
+func (s *MemoryStorage) Put(key string, r io.Reader, modTime time.Time) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[key] = memoryObject{data: data, modTime: modTime}
+
+	return nil
+}
+
+// BufferInMemory keeps downloads for the storage off the disk.
+func (s *MemoryStorage) BufferInMemory() bool {
+	return true
+}
+
+// Open returns a reader over the object's content.
+func (s *MemoryStorage) Open(key string) (io.ReadCloser, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+// Exists checks whether the object is in memory.
+func (s *MemoryStorage) Exists(key string) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, ok := s.objects[key]
+	return ok, nil
+}
+
+// Stat returns the size and modification time of the object.
+func (s *MemoryStorage) Stat(key string) (ObjectInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotExist
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+// List returns the objects with keys starting with the prefix.
+func (s *MemoryStorage) List(prefix string) ([]ObjectInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make([]ObjectInfo, 0)
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result, nil
+}
+
+// Delete removes the object from memory.
+func (s *MemoryStorage) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.objects, key)
+	return nil
+}
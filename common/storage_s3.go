@@ -0,0 +1,448 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MtimeHeader is the user metadata keeping the
+	// modification time of uploaded files.
+	s3MtimeHeader = "X-Amz-Meta-Mtime"
+
+	// s3DefaultRegion is used when neither the storage
+	// URL nor the environment specify a region.
+	s3DefaultRegion = "us-east-1"
+)
+
+// S3Storage keeps objects in a bucket of an S3 compatible
+// object store, such as AWS S3 or MinIO.
+//
+// Buckets are addressed path-style, which every compatible
+// store supports. Credentials are read from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optional
+// AWS_SESSION_TOKEN environment variables, so they don't
+// end up in logs or shell history.
+type S3Storage struct {
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	credentials s3Credentials
+	client      *http.Client
+}
+
+type s3Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// NewS3Storage creates a storage from a URL of the form
+// "s3://bucket/prefix?endpoint=http://localhost:9000&region=us-east-1".
+//
+// Without an endpoint, the AWS endpoint of the region is used.
+func NewS3Storage(u *url.URL) (*S3Storage, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("storage URL '%s' has no bucket", u)
+	}
+
+	query := u.Query()
+
+	region := query.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	rawEndpoint := query.Get("endpoint")
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	if !strings.Contains(rawEndpoint, "://") {
+		rawEndpoint = "https://" + rawEndpoint
+	}
+
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint '%s': %s", rawEndpoint, err)
+	}
+
+	credentials := s3Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKey == "" || credentials.SecretKey == "" {
+		return nil, fmt.Errorf("S3 storage requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &S3Storage{
+		endpoint:    endpoint,
+		bucket:      u.Host,
+		prefix:      strings.Trim(u.Path, "/"),
+		region:      region,
+		credentials: credentials,
+		client:      &http.Client{},
+	}, nil
+}
+
+// Put uploads the content in a single request, which S3
+// applies atomically.
+//
+// The request needs the length and hash of the content up
+// front, so readers that can't seek are spooled to a
+// temporary file first.
+func (s *S3Storage) Put(key string, r io.Reader, modTime time.Time) error {
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		spool, err := ioutil.TempFile("", "art-dl-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if _, err := io.Copy(spool, r); err != nil {
+			return err
+		}
+		body = spool
+	}
+
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, body)
+	if err != nil {
+		return err
+	}
+
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	if !modTime.IsZero() {
+		header.Set(s3MtimeHeader, modTime.UTC().Format(time.RFC3339Nano))
+	}
+
+	resp, err := s.do(http.MethodPut, s.objectPath(key), nil, header, body, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload '%s': %s", key, resp.Status)
+	}
+
+	return nil
+}
+
+// Open downloads the object.
+func (s *S3Storage) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.objectPath(key), nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotExist
+	}
+
+	resp.Body.Close()
+	return nil, fmt.Errorf("failed to download '%s': %s", key, resp.Status)
+}
+
+// Exists checks whether the object is in the bucket.
+func (s *S3Storage) Exists(key string) (bool, error) {
+	_, err := s.Stat(key)
+	if err == ErrNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the size and modification time of the object. The
+// modification time is the one given to `Put`, when available.
+func (s *S3Storage) Stat(key string) (ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, s.objectPath(key), nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotExist
+	default:
+		return ObjectInfo{}, fmt.Errorf("failed to stat '%s': %s", key, resp.Status)
+	}
+
+	info := ObjectInfo{Key: key, Size: resp.ContentLength}
+	if t, err := time.Parse(time.RFC3339Nano, resp.Header.Get(s3MtimeHeader)); err == nil {
+		info.ModTime = t
+	} else if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+
+	return info, nil
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through the objects under the prefix. Listings
+// don't include user metadata, so modification times are the
+// upload times.
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	result := make([]ObjectInfo, 0)
+
+	root := ""
+	if s.prefix != "" {
+		root = s.prefix + "/"
+	}
+
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", root+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		page, err := s.listPage(query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			result = append(result, ObjectInfo{
+				Key:     strings.TrimPrefix(obj.Key, root),
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	return result, nil
+}
+
+func (s *S3Storage) listPage(query url.Values) (*listBucketResult, error) {
+	resp, err := s.do(http.MethodGet, "/"+s.bucket, query, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list bucket '%s': %s", s.bucket, resp.Status)
+	}
+
+	page := &listBucketResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, fmt.Errorf("failed to decode bucket listing: %s", err)
+	}
+
+	return page, nil
+}
+
+// Delete removes the object from the bucket.
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, s.objectPath(key), nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return fmt.Errorf("failed to delete '%s': %s", key, resp.Status)
+}
+
+func (s *S3Storage) objectPath(key string) string {
+	return "/" + s.bucket + "/" + JoinKey(s.prefix, key)
+}
+
+// do sends a signed request to the endpoint.
+func (s *S3Storage) do(method, p string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = awsEscapePath(u.Path)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil && size > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signV4(req, payloadHash, s.credentials, s.region, "s3", time.Now())
+
+	return s.client.Do(req)
+}
+
+// emptyPayloadHash is the SHA256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds an AWS Signature Version 4 to the request.
+//
+// The host and all X-Amz-* headers are signed.
+func signV4(req *http.Request, payloadHash string, credentials s3Credentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := awsEscapePath(req.URL.Path)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery sorts and encodes query parameters the way
+// signatures expect.
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscapePath escapes each segment of a path.
+func awsEscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsEscape percent-encodes everything except the unreserved
+// characters, as required by signatures.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
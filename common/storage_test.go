@@ -0,0 +1,207 @@
+package common
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+	// Arrange
+	storages := map[string]Storage{
+		"local":  NewLocalStorage(t.TempDir()),
+		"memory": NewMemoryStorage(),
+	}
+	mtime := time.Date(2019, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	for name, storage := range storages {
+		// Act
+		if err := storage.Put("deviantart/one/a.jpg", strings.NewReader("aaaa"), mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put("deviantart/two/b.jpg", strings.NewReader("bb"), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Delete("deviantart/two/b.jpg"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Assert
+		info, err := storage.Stat("deviantart/one/a.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != 4 {
+			t.Fatalf("%s: Expected %d, actual %d", name, 4, info.Size)
+		}
+		if !info.ModTime.Equal(mtime) {
+			t.Fatalf("%s: Expected %s, actual %s", name, mtime, info.ModTime)
+		}
+		if exists, _ := storage.Exists("deviantart/two/b.jpg"); exists {
+			t.Fatalf("%s: Expected deleted file to not exist", name)
+		}
+		if _, err := storage.Stat("deviantart/two/b.jpg"); err != ErrNotExist {
+			t.Fatalf("%s: Expected %v, actual %v", name, ErrNotExist, err)
+		}
+		list, err := storage.List("deviantart/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Key != "deviantart/one/a.jpg" {
+			t.Fatalf("%s: Expected only 'deviantart/one/a.jpg', actual %+v", name, list)
+		}
+	}
+}
+
+// fakeS3 serves the subset of the S3 API used by `S3Storage`,
+// keeping objects in memory.
+func fakeS3(t *testing.T, bucket string) *httptest.Server {
+	objects := NewMemoryStorage()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/"+bucket:
+			list, _ := objects.List(r.URL.Query().Get("prefix"))
+			result := listBucketResult{}
+			for _, obj := range list {
+				result.Contents = append(result.Contents, struct {
+					Key          string
+					Size         int64
+					LastModified time.Time
+				}{obj.Key, obj.Size, obj.ModTime})
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodPut:
+			mtime, _ := time.Parse(time.RFC3339Nano, r.Header.Get(s3MtimeHeader))
+			objects.Put(key, r.Body, mtime)
+		case r.Method == http.MethodHead:
+			info, err := objects.Stat(key)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+			w.Header().Set(s3MtimeHeader, info.ModTime.Format(time.RFC3339Nano))
+		case r.Method == http.MethodDelete:
+			objects.Delete(key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Fatalf("Unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+}
+
+func TestS3Storage(t *testing.T) {
+	// Arrange
+	server := fakeS3(t, "art")
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	u, _ := url.Parse("s3://art/archive?endpoint=" + server.URL)
+	storage, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2019, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	// Act
+	if err := storage.Put("deviantart/one/a b.jpg", strings.NewReader("aaaa"), mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := storage.Stat("deviantart/one/a b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := storage.List("deviantart/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete("deviantart/one/a b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := storage.Exists("deviantart/one/a b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if info.Size != 4 {
+		t.Fatalf("Expected %d, actual %d", 4, info.Size)
+	}
+	if !info.ModTime.Equal(mtime) {
+		t.Fatalf("Expected %s, actual %s", mtime, info.ModTime)
+	}
+	if len(list) != 1 || list[0].Key != "deviantart/one/a b.jpg" {
+		t.Fatalf("Expected only 'deviantart/one/a b.jpg', actual %+v", list)
+	}
+	if exists {
+		t.Fatalf("Expected deleted object to not exist")
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// Arrange
+	// "get-vanilla" from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	credentials := s3Credentials{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+
+	// Act
+	signV4(req, emptyPayloadHash, credentials, "us-east-1", "service", now)
+
+	// Assert
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Fatalf("Expected %s, actual %s", expected, actual)
+	}
+}
+
+func TestSessionDownloadToStorage(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	session, err := NewSession(&Config{Directory: t.TempDir(), Storage: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := Asset{URL: server.URL + "/a.jpg", Site: "deviantart", User: "one"}
+
+	// Act
+	key, err := session.Download(&asset, "{site}/{user}/{filename}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if key != "deviantart/one/a.jpg" {
+		t.Fatalf("Expected %s, actual %s", "deviantart/one/a.jpg", key)
+	}
+	r, err := session.Storage.(*MemoryStorage).Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "data" {
+		t.Fatalf("Expected %s, actual %s", "data", data)
+	}
+	if entry, ok := session.Manifest.FindURL(asset.URL); !ok || entry.Size != 4 {
+		t.Fatalf("Expected manifest entry of %d bytes, actual %+v", 4, entry)
+	}
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TarStorage writes each file as an entry of a tar stream, as
+// soon as it's complete. Nothing is kept on disk, and files can't
+// be read back, so only files written during the run exist.
+//
+// Entries are written one at a time, so files from concurrent
+// downloads don't interleave in the stream.
+type TarStorage struct {
+	w       *tar.Writer
+	closer  io.Closer
+	written map[string]ObjectInfo
+	err     error
+	lock    *sync.Mutex // pointer to avoid copy
+}
+
+// NewTarStorage creates a storage streaming to the writer.
+func NewTarStorage(w io.Writer) *TarStorage {
+	return &TarStorage{
+		w:       tar.NewWriter(w),
+		written: make(map[string]ObjectInfo),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// OpenTarStorage creates a storage streaming to the named file,
+// or to standard output when the name is "-".
+func OpenTarStorage(name string) (*TarStorage, error) {
+	if name == "-" {
+		return NewTarStorage(os.Stdout), nil
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tar file: %s", err)
+	}
+
+	s := NewTarStorage(file)
+	s.closer = file
+
+	return s, nil
+}
+
+// BufferInMemory keeps downloads for the stream off the disk.
+func (s *TarStorage) BufferInMemory() bool {
+	return true
+}
+
+// Put writes the file as the next entry of the stream. The size
+// of the entry must be known before its content is written, so
+// readers that can't seek are read into memory first.
+func (s *TarStorage) Put(key string, r io.Reader, modTime time.Time) error {
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     key,
+		Size:     end - start,
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// A failed entry leaves the stream unusable
+	if s.err != nil {
+		return s.err
+	}
+
+	if err := s.w.WriteHeader(header); err != nil {
+		s.err = err
+		return err
+	}
+
+	if _, err := io.Copy(s.w, body); err != nil {
+		s.err = err
+		return err
+	}
+
+	// Keep the entry whole in the receiving end
+	if err := s.w.Flush(); err != nil {
+		s.err = err
+		return err
+	}
+
+	s.written[key] = ObjectInfo{Key: key, Size: header.Size, ModTime: modTime}
+
+	return nil
+}
+
+// Exists checks whether the file was written during the run.
+func (s *TarStorage) Exists(key string) (bool, error) {
+	_, err := s.Stat(key)
+	if err == ErrNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the size and modification time of a file written
+// during the run.
+func (s *TarStorage) Stat(key string) (ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, ok := s.written[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotExist
+	}
+	return info, nil
+}
+
+// List returns the files written during the run.
+func (s *TarStorage) List(prefix string) ([]ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]ObjectInfo, 0)
+	for key, info := range s.written {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, info)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result, nil
+}
+
+// Delete fails, since entries can't be taken back out of a stream.
+func (s *TarStorage) Delete(key string) error {
+	return errors.New("files can't be deleted from a tar stream")
+}
+
+// Close ends the stream.
+func (s *TarStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.w.Close()
+
+	if s.closer != nil {
+		if cerr := s.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTarStorageConcurrent(t *testing.T) {
+	// Arrange
+	var buf bytes.Buffer
+	storage := NewTarStorage(&buf)
+	mtime := time.Date(2019, 2, 3, 4, 5, 6, 0, time.UTC)
+	count := 20
+
+	// Act
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("deviantart/one/%d.jpg", i)
+			content := strings.NewReader(strings.Repeat(key, 1000))
+			if err := storage.Put(key, content, mtime); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	r := tar.NewReader(&buf)
+	entries := 0
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != strings.Repeat(header.Name, 1000) {
+			t.Fatalf("Entry '%s' has content of another entry", header.Name)
+		}
+		if !header.ModTime.Equal(mtime) {
+			t.Fatalf("Expected %s, actual %s", mtime, header.ModTime)
+		}
+		entries++
+	}
+	if entries != count {
+		t.Fatalf("Expected %d, actual %d", count, entries)
+	}
+}
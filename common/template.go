@@ -0,0 +1,232 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultDateLayout is used by the date field when the template
+// doesn't give a layout.
+const defaultDateLayout string = "2006-01-02"
+
+// PathTemplate lays out where downloaded files are stored, for
+// example "{site}/{user}/{date:2006}/{title}_{index}.{ext}".
+//
+// Fields are written in braces, some taking an argument after
+// a colon:
+//
+//	{site}         site name, eg. "artstation"
+//	{user}         gallery username
+//	{artwork_id}   identifier of the artwork on the site
+//	{title}        title of the artwork
+//	{index}        position of the file in its artwork, {index:3} pads to 3 digits
+//	{date:layout}  publish date, formatted with a Go time layout, whose
+//	               slashes separate folders
+//	{tags}         tags of the artwork, separated by dashes
+//	{filename}     file name in the URL
+//	{name}         file name in the URL, without the extension
+//	{ext}          file extension, without the leading period
+//
+// Slashes separate folders. Field values are sanitized so they
+// can't add folders of their own, with the folder or file name
+// sanitizers depending on where they appear.
+type PathTemplate struct {
+	text     string
+	segments [][]templatePart
+}
+
+// templatePart is either literal text or a field.
+type templatePart struct {
+	literal string
+	field   string
+	arg     string
+}
+
+// templateFields are the names of the supported fields.
+var templateFields = map[string]bool{
+	"site":       true,
+	"user":       true,
+	"artwork_id": true,
+	"title":      true,
+	"index":      true,
+	"date":       true,
+	"tags":       true,
+	"filename":   true,
+	"name":       true,
+	"ext":        true,
+}
+
+// ParsePathTemplate parses and validates a template.
+func ParsePathTemplate(text string) (*PathTemplate, error) {
+	t := &PathTemplate{text: text}
+
+	// Fields are read before splitting the folders, as date
+	// layouts may hold slashes of their own.
+	parts := make([]templatePart, 0)
+	for rest := text; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			parts = append(parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{literal: rest[:open]})
+		}
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("template '%s' has an unclosed field", text)
+		}
+
+		field := rest[open+1 : open+end]
+		arg := ""
+		if i := strings.IndexByte(field, ':'); i >= 0 {
+			field, arg = field[:i], field[i+1:]
+		}
+
+		if !templateFields[field] {
+			return nil, fmt.Errorf("template '%s' has unknown field '%s'", text, field)
+		}
+		if field == "index" && arg != "" {
+			if _, err := strconv.Atoi(arg); err != nil {
+				return nil, fmt.Errorf("template '%s' has invalid index width '%s'", text, arg)
+			}
+		}
+
+		parts = append(parts, templatePart{field: field, arg: arg})
+		rest = rest[open+end+1:]
+	}
+
+	// Slashes in literals and date layouts separate folders, so
+	// {date:2006/01} becomes a year folder holding month folders.
+	segment := make([]templatePart, 0)
+	for _, part := range parts {
+		var pieces []string
+		switch {
+		case part.field == "":
+			pieces = strings.Split(part.literal, "/")
+		case part.field == "date" && part.arg != "":
+			pieces = strings.Split(part.arg, "/")
+		default:
+			segment = append(segment, part)
+			continue
+		}
+
+		for i, piece := range pieces {
+			if i > 0 {
+				t.addSegment(segment)
+				segment = make([]templatePart, 0)
+			}
+			if piece == "" {
+				continue
+			}
+			if part.field == "" {
+				segment = append(segment, templatePart{literal: piece})
+			} else {
+				segment = append(segment, templatePart{field: part.field, arg: piece})
+			}
+		}
+	}
+	t.addSegment(segment)
+
+	if len(t.segments) == 0 {
+		return nil, fmt.Errorf("template is empty")
+	}
+
+	return t, nil
+}
+
+// addSegment appends a folder, or the file name, to the template.
+// Empty segments are dropped.
+func (t *PathTemplate) addSegment(parts []templatePart) {
+	if len(parts) > 0 {
+		t.segments = append(t.segments, parts)
+	}
+}
+
+// String returns the text of the template.
+func (t *PathTemplate) String() string {
+	return t.text
+}
+
+// Execute fills in the template with the asset's fields. Returns
+// the storage key of the asset.
+func (t *PathTemplate) Execute(asset *Asset) (string, error) {
+	segments := make([]string, 0, len(t.segments))
+
+	for i, parts := range t.segments {
+		last := i == len(t.segments)-1
+
+		var b strings.Builder
+		for _, part := range parts {
+			if part.field == "" {
+				b.WriteString(part.literal)
+				continue
+			}
+
+			value := part.value(asset)
+			if last {
+				value = SanitizeFilename(value)
+			} else {
+				value = SanitizeDirname(value)
+			}
+			b.WriteString(value)
+		}
+
+		// Leading periods would hide files, or climb
+		// out of the output directory.
+		segment := strings.TrimLeft(strings.TrimSpace(b.String()), ".")
+		if segment == "" {
+			if last {
+				return "", fmt.Errorf("template '%s' gives no file name for '%s'", t.text, asset.URL)
+			}
+			continue
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return JoinKey(segments...), nil
+}
+
+// value returns the unsanitized value of a field.
+func (p *templatePart) value(asset *Asset) string {
+	switch p.field {
+	case "site":
+		return asset.Site
+	case "user":
+		return asset.User
+	case "artwork_id":
+		return asset.ArtworkID
+	case "title":
+		return asset.Title
+	case "index":
+		width, _ := strconv.Atoi(p.arg)
+		return fmt.Sprintf("%0*d", width, asset.Index)
+	case "date":
+		if asset.Published.IsZero() {
+			return ""
+		}
+		layout := p.arg
+		if layout == "" {
+			layout = defaultDateLayout
+		}
+		return asset.Published.Format(layout)
+	case "tags":
+		return strings.Join(asset.Tags, "-")
+	case "filename":
+		return asset.Filename()
+	case "name":
+		fn := asset.Filename()
+		return strings.TrimSuffix(fn, path.Ext(fn))
+	case "ext":
+		if ext := path.Ext(asset.Filename()); ext != "" {
+			return strings.ToLower(strings.TrimPrefix(ext, "."))
+		}
+		return asset.Type()
+	}
+
+	return ""
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathTemplate(t *testing.T) {
+	// Arrange
+	asset := Asset{
+		URL:       "https://cdn.example.com/images/Dragon.JPG?1234",
+		Site:      "artstation",
+		User:      "artist",
+		ArtworkID: "aB3x",
+		Index:     2,
+		Title:     "A Dragon: Fire/Ice",
+		Tags:      []string{"dragon", "concept"},
+		Published: time.Date(2019, 7, 19, 10, 0, 0, 0, time.UTC),
+	}
+
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{"{site}/{user}/{filename}", "artstation/artist/Dragon.JPG"},
+		{"{site}/{user}/{title}/{filename}", "artstation/artist/A Dragon- Fire-Ice/Dragon.JPG"},
+		{"{user}/{date:2006-01}/{artwork_id}_{index:3}.{ext}", "artist/2019-07/aB3x_002.jpg"},
+		{"{user}/{tags}/{name}.{ext}", "artist/dragon-concept/Dragon.jpg"},
+		{"{user}/{date:2006/01}/{filename}", "artist/2019/07/Dragon.JPG"},
+		{"{user}/{date:2006/01-02}_{filename}", "artist/2019/07-19_Dragon.JPG"},
+		{"{site}/{artwork_id}/../{filename}", "artstation/aB3x/Dragon.JPG"},
+	}
+
+	for _, c := range cases {
+		// Act
+		template, err := ParsePathTemplate(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := template.Execute(&asset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Assert
+		if key != c.expected {
+			t.Fatalf("Expected %s, actual %s", c.expected, key)
+		}
+	}
+}
+
+func TestParsePathTemplateInvalid(t *testing.T) {
+	for _, text := range []string{"", "{site}/{unknown}", "{site}/{user", "{index:x}"} {
+		if _, err := ParsePathTemplate(text); err == nil {
+			t.Fatalf("Expected error for template '%s'", text)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dupes
+
+import (
+	"sort"
+)
+
+// Image is a file in the archive along with its fingerprint.
+type Image struct {
+	Path string
+	Size int64
+	Fingerprint
+}
+
+// Pixels returns the resolution of the image.
+func (img *Image) Pixels() int {
+	return img.Width * img.Height
+}
+
+// Algorithm selects which hash images are compared by.
+type Algorithm func(fp Fingerprint) Hash
+
+var (
+	// ByDHash compares images by difference hash
+	ByDHash Algorithm = func(fp Fingerprint) Hash { return fp.DHash }
+
+	// ByPHash compares images by perceptual hash
+	ByPHash Algorithm = func(fp Fingerprint) Hash { return fp.PHash }
+)
+
+// Cluster groups images whose hashes are at least as similar as
+// the threshold, from 0 to 1. Every image in a cluster is similar
+// to every other one, so images that are only alike through a
+// chain of similar images aren't grouped together.
+//
+// Clusters are grown from the best images first, so an image
+// similar to several clusters joins the best one.
+//
+// Only clusters of two or more images are returned. Images in
+// each cluster are ordered best first, by resolution and then
+// file size.
+func Cluster(images []Image, algorithm Algorithm, threshold float64) [][]Image {
+	sorted := make([]Image, len(images))
+	copy(sorted, images)
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].Pixels() != sorted[b].Pixels() {
+			return sorted[a].Pixels() > sorted[b].Pixels()
+		}
+		if sorted[a].Size != sorted[b].Size {
+			return sorted[a].Size > sorted[b].Size
+		}
+		return sorted[a].Path < sorted[b].Path
+	})
+
+	hashes := make([]Hash, len(sorted))
+	for i := range sorted {
+		hashes[i] = algorithm(sorted[i].Fingerprint)
+	}
+
+	clustered := make([]bool, len(sorted))
+	clusters := make([][]Image, 0)
+
+	for i := range sorted {
+		if clustered[i] {
+			continue
+		}
+
+		members := []int{i}
+		for j := i + 1; j < len(sorted); j++ {
+			if clustered[j] {
+				continue
+			}
+
+			// Complete linkage, similar to all members
+			similar := true
+			for _, m := range members {
+				if hashes[m].Similarity(hashes[j]) < threshold {
+					similar = false
+					break
+				}
+			}
+			if similar {
+				members = append(members, j)
+			}
+		}
+
+		if len(members) < 2 {
+			continue
+		}
+
+		cluster := make([]Image, 0, len(members))
+		for _, m := range members {
+			clustered[m] = true
+			cluster = append(cluster, sorted[m])
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	// Stable output for reports
+	sort.Slice(clusters, func(a, b int) bool { return clusters[a][0].Path < clusters[b][0].Path })
+
+	return clusters
+}
@@ -0,0 +1,88 @@
+package dupes
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradient draws a test image with a diagonal gradient and a
+// dark block, at any resolution.
+func gradient(w, h int, flip bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*255/w + y*255/h) / 2)
+			if flip {
+				v = 255 - v
+			}
+			if x < w/4 && y < h/4 {
+				v = 0
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestHashResolutionInvariant(t *testing.T) {
+	// Arrange
+	small := gradient(64, 48, false)
+	large := gradient(640, 480, false)
+	other := gradient(640, 480, true)
+
+	// Act & Assert
+	if s := PHash(small).Similarity(PHash(large)); s < 0.9 {
+		t.Fatalf("Expected similar pHash, actual similarity %f", s)
+	}
+	if s := DHash(small).Similarity(DHash(large)); s < 0.9 {
+		t.Fatalf("Expected similar dHash, actual similarity %f", s)
+	}
+	if s := PHash(large).Similarity(PHash(other)); s >= 0.9 {
+		t.Fatalf("Expected different pHash, actual similarity %f", s)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	// Arrange
+	images := []Image{
+		{Path: "a.jpg", Size: 10, Fingerprint: Fingerprint{PHash: 0xFF00, Width: 100, Height: 100}},
+		{Path: "b.png", Size: 20, Fingerprint: Fingerprint{PHash: 0xFF01, Width: 200, Height: 200}},
+		{Path: "c.png", Size: 30, Fingerprint: Fingerprint{PHash: 0x00FF00FF00FF00FF, Width: 50, Height: 50}},
+	}
+
+	// Act
+	clusters := Cluster(images, ByPHash, 0.95)
+
+	// Assert
+	if len(clusters) != 1 {
+		t.Fatalf("Expected %d, actual %d", 1, len(clusters))
+	}
+	if len(clusters[0]) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(clusters[0]))
+	}
+	if clusters[0][0].Path != "b.png" {
+		t.Fatalf("Expected highest resolution first, actual %s", clusters[0][0].Path)
+	}
+}
+
+func TestClusterChain(t *testing.T) {
+	// Arrange
+	// a~b and b~c, 3 bits apart each, but a and c are 6 bits apart
+	images := []Image{
+		{Path: "a.jpg", Size: 10, Fingerprint: Fingerprint{PHash: 0x00, Width: 200, Height: 200}},
+		{Path: "b.jpg", Size: 10, Fingerprint: Fingerprint{PHash: 0x07, Width: 100, Height: 100}},
+		{Path: "c.jpg", Size: 10, Fingerprint: Fingerprint{PHash: 0x3F, Width: 100, Height: 100}},
+	}
+
+	// Act
+	clusters := Cluster(images, ByPHash, 0.95)
+
+	// Assert
+	if len(clusters) != 1 {
+		t.Fatalf("Expected %d, actual %d", 1, len(clusters))
+	}
+	if len(clusters[0]) != 2 || clusters[0][0].Path != "a.jpg" || clusters[0][1].Path != "b.jpg" {
+		t.Fatalf("Expected [a.jpg b.jpg], actual %v", clusters[0])
+	}
+}
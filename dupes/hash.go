@@ -0,0 +1,210 @@
+package dupes
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"  // register decoder
+	_ "image/jpeg" // register decoder
+	_ "image/png"  // register decoder
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/bmp"  // register decoder
+	_ "golang.org/x/image/tiff" // register decoder
+	_ "golang.org/x/image/webp" // register decoder
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// hashBits is the number of bits in each hash
+	hashBits int = 64
+
+	// dctSize is the size of the image the perceptual hash
+	// transforms, before keeping the lowest frequencies.
+	dctSize int = 32
+)
+
+// Hash is a 64 bit image fingerprint. Similar images have
+// hashes with a small Hamming distance.
+type Hash uint64
+
+// String formats the hash as hexadecimal.
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// ParseHash reads a hash formatted by `String`.
+func ParseHash(s string) (Hash, error) {
+	n, err := strconv.ParseUint(s, 16, 64)
+	return Hash(n), err
+}
+
+// Similarity returns the fraction of bits two hashes share,
+// from 0 for opposites to 1 for identical.
+func (h Hash) Similarity(other Hash) float64 {
+	distance := bits.OnesCount64(uint64(h ^ other))
+	return 1 - float64(distance)/float64(hashBits)
+}
+
+// Fingerprint holds the hashes and dimensions of an image.
+type Fingerprint struct {
+	DHash  Hash
+	PHash  Hash
+	Width  int
+	Height int
+}
+
+// FingerprintFile decodes an image file and hashes it.
+func FingerprintFile(fp string) (Fingerprint, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("failed to decode '%s': %s", fp, err)
+	}
+
+	bounds := img.Bounds()
+
+	return Fingerprint{
+		DHash:  DHash(img),
+		PHash:  PHash(img),
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}, nil
+}
+
+// DHash computes the difference hash of an image.
+//
+// The image is shrunk to 9x8 grey pixels, and each bit records
+// whether a pixel is brighter than its right neighbour.
+func DHash(img image.Image) Hash {
+	gray := shrink(img, 9, 8)
+
+	var h Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if gray.GrayAt(x, y).Y > gray.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+
+	return h
+}
+
+// PHash computes the perceptual hash of an image.
+//
+// The image is shrunk to 32x32 grey pixels and transformed with
+// a discrete cosine transform. Each bit records whether one of
+// the 8x8 lowest frequencies is above their median.
+func PHash(img image.Image) Hash {
+	gray := shrink(img, dctSize, dctSize)
+
+	pixels := make([][]float64, dctSize)
+	for y := range pixels {
+		pixels[y] = make([]float64, dctSize)
+		for x := range pixels[y] {
+			pixels[y][x] = float64(gray.GrayAt(x, y).Y)
+		}
+	}
+
+	coeffs := dct2D(pixels)
+
+	low := make([]float64, 0, hashBits)
+	for y := 0; y < 8; y++ {
+		low = append(low, coeffs[y][:8]...)
+	}
+
+	sorted := append([]float64(nil), low...)
+	sort.Float64s(sorted)
+	median := (sorted[hashBits/2-1] + sorted[hashBits/2]) / 2
+
+	var h Hash
+	for _, c := range low {
+		h <<= 1
+		if c > median {
+			h |= 1
+		}
+	}
+
+	return h
+}
+
+// shrink scales the image down to a grey image of the given size.
+func shrink(img image.Image, w, h int) *image.Gray {
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// dct2D applies a type II discrete cosine transform to the rows,
+// then the columns, of a square matrix.
+func dct2D(m [][]float64) [][]float64 {
+	n := len(m)
+
+	rows := make([][]float64, n)
+	for y := range m {
+		rows[y] = dct1D(m[y])
+	}
+
+	result := make([][]float64, n)
+	for y := range result {
+		result[y] = make([]float64, n)
+	}
+
+	column := make([]float64, n)
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			column[y] = rows[y][x]
+		}
+		for y, c := range dct1D(column) {
+			result[y][x] = c
+		}
+	}
+
+	return result
+}
+
+func dct1D(v []float64) []float64 {
+	n := len(v)
+	result := make([]float64, n)
+
+	for k := range result {
+		var sum float64
+		for i, x := range v {
+			sum += x * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*float64(k))
+		}
+		result[k] = sum
+	}
+
+	return result
+}
+
+// imageTypes are the file types that can be fingerprinted.
+var imageTypes = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// IsImage checks whether the file can be fingerprinted, based
+// on its extension.
+func IsImage(fp string) bool {
+	return imageTypes[strings.ToLower(filepath.Ext(fp))]
+}
@@ -5,6 +5,8 @@ go 1.17
 require (
 	github.com/mmcdole/gofeed v1.0.0-beta2.0.20190420154928-0e68beaf6fdf
 	github.com/sirupsen/logrus v1.4.3-0.20200204224615-947831125f31
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/image v0.0.0-20191206065243-da761ea9ff43
 )
 
 require (
@@ -0,0 +1,218 @@
+package index
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/processors"
+)
+
+// projectSites are the sites whose artworks are projects of
+// several files, which get a page of their own.
+var projectSites = map[string]bool{
+	"artstation": true,
+}
+
+// Site groups the artists downloaded from a site.
+type Site struct {
+	Name    string
+	Artists []*Artist
+}
+
+// Artist groups the artworks of a gallery.
+type Artist struct {
+	Site     string
+	Name     string
+	Artworks []*Artwork
+}
+
+// Artwork is one or more files published together.
+type Artwork struct {
+	Site      string
+	User      string
+	ID        string
+	Title     string
+	PageURL   string
+	Tags      []string
+	Published time.Time
+	Files     []*File
+}
+
+// HasPage checks whether the artwork gets a page of its own.
+func (a *Artwork) HasPage() bool {
+	return a.ID != "" && (projectSites[a.Site] || len(a.Files) > 1)
+}
+
+// File is a downloaded file of an artwork.
+type File struct {
+	// Path and Thumbnail are relative to the output directory,
+	// using forward slashes. Thumbnail is empty for files
+	// without one.
+	Path      string
+	Thumbnail string
+	Size      int64
+	Width     int
+	Height    int
+}
+
+// Gallery is everything in an output directory, as shown by
+// the index.
+type Gallery struct {
+	Sites []*Site
+}
+
+// Load gathers the files of an output directory, described by
+// whatever the manifest and sidecars know about them.
+//
+// Files the manifest doesn't know are attributed to a site and
+// artist by the first two folders of their path.
+func Load(directory string) (*Gallery, error) {
+	manifest, err := artdl.LoadManifest(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecars, err := artdl.LoadSidecars(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	described := make(map[string]*artdl.Sidecar)
+	for _, sidecar := range sidecars {
+		for _, f := range sidecar.Files {
+			described[f.Path] = sidecar
+		}
+	}
+
+	artworks := make(map[string]*Artwork)
+
+	err = artdl.WalkArchive(directory, func(fp string, info os.FileInfo) error {
+		if strings.HasSuffix(fp, artdl.SidecarSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(directory, fp)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		file := &File{Path: key, Size: info.Size()}
+		if processors.IsThumbnailable(fp) {
+			if _, err := os.Stat(processors.ThumbnailPath(fp)); err == nil {
+				thumb, _ := filepath.Rel(directory, processors.ThumbnailPath(fp))
+				file.Thumbnail = filepath.ToSlash(thumb)
+			}
+		}
+
+		entry, tracked := manifest.Get(key)
+		if tracked {
+			file.Width, file.Height = entry.Width, entry.Height
+		}
+
+		artwork := newArtwork(key, entry, described[key])
+		id := path.Join(artwork.Site, artwork.User, artwork.ID)
+		if artwork.ID == "" {
+			id = key
+		}
+
+		if existing, ok := artworks[id]; ok {
+			existing.Files = append(existing.Files, file)
+		} else {
+			artwork.Files = []*File{file}
+			artworks[id] = artwork
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return group(artworks), nil
+}
+
+// newArtwork describes the artwork a file belongs to.
+func newArtwork(key string, entry artdl.ManifestEntry, sidecar *artdl.Sidecar) *Artwork {
+	artwork := &Artwork{Site: entry.Site, User: entry.User}
+
+	if sidecar != nil {
+		artwork.Site, artwork.User = sidecar.Site, sidecar.User
+		artwork.ID = sidecar.ArtworkID
+		artwork.Title = sidecar.Title
+		artwork.PageURL = sidecar.PageURL
+		artwork.Tags = sidecar.Tags
+		if sidecar.Published != nil {
+			artwork.Published = *sidecar.Published
+		}
+	}
+
+	segments := strings.Split(key, "/")
+	if artwork.Site == "" && len(segments) > 2 {
+		artwork.Site = segments[0]
+	}
+	if artwork.User == "" && len(segments) > 2 {
+		artwork.User = segments[1]
+	}
+	if artwork.Site == "" {
+		artwork.Site = "other"
+	}
+
+	if artwork.Title == "" {
+		name := segments[len(segments)-1]
+		artwork.Title = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	return artwork
+}
+
+// group sorts artworks into sites and artists, newest first.
+func group(artworks map[string]*Artwork) *Gallery {
+	sites := make(map[string]*Site)
+	artists := make(map[string]*Artist)
+
+	for _, artwork := range artworks {
+		site, ok := sites[artwork.Site]
+		if !ok {
+			site = &Site{Name: artwork.Site}
+			sites[artwork.Site] = site
+		}
+
+		id := artwork.Site + "/" + artwork.User
+		artist, ok := artists[id]
+		if !ok {
+			artist = &Artist{Site: artwork.Site, Name: artwork.User}
+			artists[id] = artist
+			site.Artists = append(site.Artists, artist)
+		}
+
+		sort.Slice(artwork.Files, func(i, j int) bool { return artwork.Files[i].Path < artwork.Files[j].Path })
+		artist.Artworks = append(artist.Artworks, artwork)
+	}
+
+	gallery := &Gallery{Sites: make([]*Site, 0, len(sites))}
+	for _, site := range sites {
+		sort.Slice(site.Artists, func(i, j int) bool { return site.Artists[i].Name < site.Artists[j].Name })
+
+		for _, artist := range site.Artists {
+			sort.Slice(artist.Artworks, func(i, j int) bool {
+				a, b := artist.Artworks[i], artist.Artworks[j]
+				if !a.Published.Equal(b.Published) {
+					return a.Published.After(b.Published)
+				}
+				return a.Files[0].Path < b.Files[0].Path
+			})
+		}
+
+		gallery.Sites = append(gallery.Sites, site)
+	}
+
+	sort.Slice(gallery.Sites, func(i, j int) bool { return gallery.Sites[i].Name < gallery.Sites[j].Name })
+
+	return gallery
+}
@@ -0,0 +1,324 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+// Dirname is the name of the folder the site is generated in, in
+// the root of the output directory. It's hidden, so the pages
+// aren't mistaken for downloaded files.
+const Dirname string = ".index"
+
+// Stats counts the pages of a generated site.
+type Stats struct {
+	Written   int
+	Unchanged int
+	Removed   int
+}
+
+// page is the data a page is rendered from.
+type page struct {
+	// Path is relative to the site folder, using forward slashes
+	Path        string
+	Title       string
+	Breadcrumbs []link
+	Cards       []card
+}
+
+type link struct {
+	Title string
+	Href  string
+}
+
+// card is an entry in the grid of a page.
+type card struct {
+	Title    string
+	Subtitle string
+	Href     string
+	Thumb    string
+	Source   string
+	Tags     []string
+	Search   string
+}
+
+// Generate writes a static site browsing the output directory
+// into its index folder.
+//
+// Pages are only written when their content changed since the
+// last run, and pages of artworks that are gone are removed.
+func Generate(directory string) (Stats, error) {
+	stats := Stats{}
+
+	gallery, err := Load(directory)
+	if err != nil {
+		return stats, err
+	}
+
+	root := filepath.Join(directory, Dirname)
+	pages := gallery.pages()
+	generated := make(map[string]bool, len(pages))
+
+	for _, p := range pages {
+		var b bytes.Buffer
+		if err := pageTemplate.Execute(&b, p); err != nil {
+			return stats, fmt.Errorf("failed to render '%s': %s", p.Path, err)
+		}
+
+		fp := filepath.Join(root, filepath.FromSlash(p.Path))
+		generated[fp] = true
+
+		if existing, err := ioutil.ReadFile(fp); err == nil && bytes.Equal(existing, b.Bytes()) {
+			stats.Unchanged++
+			continue
+		}
+
+		if err := writePage(fp, b.Bytes()); err != nil {
+			return stats, err
+		}
+		stats.Written++
+	}
+
+	err = filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || generated[fp] || filepath.Ext(fp) != ".html" {
+			return err
+		}
+
+		if err := os.Remove(fp); err != nil {
+			return err
+		}
+		stats.Removed++
+
+		return nil
+	})
+
+	return stats, err
+}
+
+// writePage writes a page through a temporary file, so a browser
+// never sees it half written.
+func writePage(fp string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fp), os.ModePerm); err != nil {
+		return err
+	}
+
+	tfp := filepath.Join(filepath.Dir(fp), artdl.TempFilename(filepath.Base(fp)))
+	if err := ioutil.WriteFile(tfp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tfp, fp)
+}
+
+// pages lays out the site: a landing page, a page per site and
+// artist, and a page per project.
+func (g *Gallery) pages() []*page {
+	home := &page{Path: "index.html", Title: "art-dl"}
+	pages := []*page{home}
+
+	for _, site := range g.Sites {
+		sitePage := &page{
+			Path:        path.Join(pageDir(site.Name), "index.html"),
+			Title:       site.Name,
+			Breadcrumbs: []link{{Title: "art-dl", Href: home.Path}},
+		}
+		pages = append(pages, sitePage)
+
+		var siteArtworks int
+		for _, artist := range site.Artists {
+			artistPage := &page{
+				Path:        path.Join(pageDir(site.Name), pageDir(artist.Name), "index.html"),
+				Title:       artistTitle(artist),
+				Breadcrumbs: []link{{Title: "art-dl", Href: home.Path}, {Title: site.Name, Href: sitePage.Path}},
+			}
+			pages = append(pages, artistPage)
+
+			for _, artwork := range artist.Artworks {
+				entry := artworkCard(artwork)
+
+				if artwork.HasPage() {
+					projectPage := &page{
+						Path:  path.Join(path.Dir(artistPage.Path), artdl.SanitizeFilename(artwork.ID)+".html"),
+						Title: artwork.Title,
+					}
+					projectPage.Breadcrumbs = append(projectPage.Breadcrumbs, artistPage.Breadcrumbs...)
+					projectPage.Breadcrumbs = append(projectPage.Breadcrumbs, link{Title: artistPage.Title, Href: artistPage.Path})
+
+					for _, f := range artwork.Files {
+						projectPage.Cards = append(projectPage.Cards, fileCard(f))
+					}
+					pages = append(pages, projectPage)
+
+					entry.Href = projectPage.Path
+				}
+
+				artistPage.Cards = append(artistPage.Cards, entry)
+			}
+
+			cover := artistPage.Cards[0]
+			sitePage.Cards = append(sitePage.Cards, card{
+				Title:    artistPage.Title,
+				Subtitle: plural(len(artist.Artworks), "artwork"),
+				Href:     artistPage.Path,
+				Thumb:    cover.Thumb,
+				Search:   strings.ToLower(artistPage.Title),
+			})
+			siteArtworks += len(artist.Artworks)
+		}
+
+		home.Cards = append(home.Cards, card{
+			Title:    site.Name,
+			Subtitle: plural(len(site.Artists), "artist") + ", " + plural(siteArtworks, "artwork"),
+			Href:     sitePage.Path,
+			Thumb:    sitePage.Cards[0].Thumb,
+			Search:   strings.ToLower(site.Name),
+		})
+	}
+
+	// Links are written relative to the site folder, and made
+	// relative to each page here, so the site can be moved.
+	for _, p := range pages {
+		for i := range p.Breadcrumbs {
+			p.Breadcrumbs[i].Href = relative(p.Path, p.Breadcrumbs[i].Href)
+		}
+		for i := range p.Cards {
+			p.Cards[i].Href = relative(p.Path, p.Cards[i].Href)
+			p.Cards[i].Thumb = relative(p.Path, p.Cards[i].Thumb)
+		}
+	}
+
+	return pages
+}
+
+func artworkCard(artwork *Artwork) card {
+	first := artwork.Files[0]
+
+	c := card{
+		Title:  artwork.Title,
+		Href:   archivePath(first.Path),
+		Thumb:  thumbnail(first),
+		Source: artwork.PageURL,
+		Tags:   artwork.Tags,
+		Search: strings.ToLower(artwork.Title),
+	}
+
+	parts := make([]string, 0, 2)
+	if !artwork.Published.IsZero() {
+		parts = append(parts, artwork.Published.Format("2006-01-02"))
+	}
+	if len(artwork.Files) > 1 {
+		parts = append(parts, plural(len(artwork.Files), "file"))
+	}
+	c.Subtitle = strings.Join(parts, ", ")
+
+	return c
+}
+
+func fileCard(f *File) card {
+	name := path.Base(f.Path)
+
+	c := card{
+		Title:  name,
+		Href:   archivePath(f.Path),
+		Thumb:  thumbnail(f),
+		Search: strings.ToLower(name),
+	}
+
+	if f.Width > 0 && f.Height > 0 {
+		c.Subtitle = fmt.Sprintf("%dx%d, %s", f.Width, f.Height, artdl.FormatByteSize(f.Size))
+	} else {
+		c.Subtitle = artdl.FormatByteSize(f.Size)
+	}
+
+	return c
+}
+
+// browserTypes are the file types browsers show as images.
+var browserTypes = map[string]bool{"jpg": true, "png": true, "gif": true, "webp": true}
+
+// thumbnail returns the image to show for a file, preferring its
+// thumbnail. Empty for files browsers can't show.
+func thumbnail(f *File) string {
+	if f.Thumbnail != "" {
+		return archivePath(f.Thumbnail)
+	}
+	if browserTypes[artdl.NormalizeType(path.Ext(f.Path))] {
+		return archivePath(f.Path)
+	}
+	return ""
+}
+
+// archivePath refers to a file of the output directory from the
+// site folder.
+func archivePath(key string) string {
+	return path.Join("..", key)
+}
+
+// relative turns a link from the site folder into one from the
+// given page.
+func relative(from, to string) string {
+	if to == "" {
+		return ""
+	}
+
+	// Drop the folders both share
+	fromDirs := strings.Split(path.Dir(from), "/")
+	toSegments := strings.Split(to, "/")
+	for len(fromDirs) > 0 && len(toSegments) > 1 && fromDirs[0] == toSegments[0] && fromDirs[0] != "." {
+		fromDirs, toSegments = fromDirs[1:], toSegments[1:]
+	}
+
+	segments := make([]string, 0, len(fromDirs)+len(toSegments))
+	for _, dir := range fromDirs {
+		if dir != "." {
+			segments = append(segments, "..")
+		}
+	}
+	for _, segment := range toSegments {
+		segments = append(segments, url.PathEscape(segment))
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// pageDir sanitizes a site or artist name for the pages folder.
+func pageDir(name string) string {
+	if name = artdl.SanitizeDirname(name); name == "" || strings.HasPrefix(name, ".") {
+		return "_" + name
+	}
+	return name
+}
+
+func artistTitle(artist *Artist) string {
+	if artist.Name == "" {
+		return "Unsorted"
+	}
+	return artist.Name
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// tagFilter is the filter term matching a tag, without spaces so
+// it survives being typed in the filter.
+func tagFilter(tag string) string {
+	return "tag:" + strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+}
+
+var pageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{
+	"tagFilter": tagFilter,
+	"join":      strings.Join,
+}).Parse(pageHTML))
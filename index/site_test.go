@@ -0,0 +1,90 @@
+package index
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/internal/testutil"
+)
+
+func TestGenerate(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	testutil.WriteFiles(t, dir, "artstation/one/Dragon/a.jpg", "artstation/one/Dragon/b.jpg", "deviantart/two/x.png")
+
+	sidecar := map[string][]artdl.Sidecar{"artworks": {{
+		Site:      "artstation",
+		User:      "one",
+		ArtworkID: "42",
+		Title:     "Dragon",
+		PageURL:   "https://www.artstation.com/artwork/abc",
+		Tags:      []string{"Concept Art"},
+		Files: []artdl.SidecarFile{
+			{Path: "artstation/one/Dragon/a.jpg", Index: 1},
+			{Path: "artstation/one/Dragon/b.jpg", Index: 2},
+		},
+	}}}
+	b, _ := json.Marshal(sidecar)
+	testutil.WriteFile(t, filepath.Join(dir, "artstation", "one", "Dragon", artdl.ProjectSidecarFilename), b)
+
+	// Act
+	stats, err := Generate(dir)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 6 {
+		t.Fatalf("Expected %d, actual %d", 6, stats.Written)
+	}
+
+	artist, err := ioutil.ReadFile(filepath.Join(dir, Dirname, "artstation", "one", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`href="42.html"`, `src="../../../artstation/one/Dragon/a.jpg" loading="lazy"`, "tag:concept-art", "https://www.artstation.com/artwork/abc"} {
+		if !strings.Contains(string(artist), expected) {
+			t.Fatalf("Expected artist page to contain %s", expected)
+		}
+	}
+
+	project, err := ioutil.ReadFile(filepath.Join(dir, Dirname, "artstation", "one", "42.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(project), `href="../../../artstation/one/Dragon/b.jpg"`) {
+		t.Fatalf("Expected project page to link its files")
+	}
+}
+
+func TestGenerateIncremental(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	testutil.WriteFiles(t, dir, "deviantart/one/a.jpg", "deviantart/two/b.jpg")
+	if _, err := Generate(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "deviantart", "two", "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	stats, err := Generate(dir)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Landing and site pages change, the remaining artist doesn't
+	if stats.Written != 2 || stats.Unchanged != 1 || stats.Removed != 1 {
+		t.Fatalf("Expected 2 written, 1 unchanged and 1 removed, actual %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, Dirname, "deviantart", "two", "index.html")); !os.IsNotExist(err) {
+		t.Fatalf("Expected page of removed artist to be removed")
+	}
+}
@@ -0,0 +1,87 @@
+package index
+
+// pageHTML renders every page of the site. Pages are self
+// contained, with their styles and filter script inline, so they
+// work when opened straight from disk.
+const pageHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; font-family: sans-serif; background: #16161a; color: #ddd; }
+header { padding: 1em 1.5em; background: #222228; }
+header nav a { color: #9ab; text-decoration: none; }
+header nav a::after { content: " / "; color: #666; }
+h1 { margin: 0.3em 0; font-size: 1.5em; }
+input { width: 100%; max-width: 30em; padding: 0.4em; font-size: 1em; box-sizing: border-box; }
+main { display: grid; grid-template-columns: repeat(auto-fill, minmax(220px, 1fr)); gap: 1em; padding: 1.5em; }
+.card { background: #222228; border-radius: 4px; overflow: hidden; }
+.card .thumb { display: block; height: 200px; background: #2c2c33; }
+.card img { width: 100%; height: 200px; object-fit: cover; display: block; }
+.card .info { padding: 0.5em 0.7em; }
+.card .title { color: #eee; text-decoration: none; font-weight: bold; word-break: break-word; }
+.card .subtitle, .card .source { color: #888; font-size: 0.85em; }
+.card .tags a { display: inline-block; margin: 0.2em 0.2em 0 0; padding: 0 0.4em; border-radius: 3px; background: #33333b; color: #bbb; font-size: 0.8em; text-decoration: none; }
+</style>
+</head>
+<body>
+<header>
+<nav>{{range .Breadcrumbs}}<a href="{{.Href}}">{{.Title}}</a>{{end}}</nav>
+<h1>{{.Title}}</h1>
+<input id="filter" type="search" placeholder="Filter by title, or tag:name" autofocus>
+</header>
+<main>
+{{- range .Cards}}
+<div class="card" data-search="{{.Search}}" data-tags="{{range .Tags}}{{tagFilter .}} {{end}}">
+<a class="thumb" href="{{.Href}}">{{if .Thumb}}<img src="{{.Thumb}}" loading="lazy" alt="">{{end}}</a>
+<div class="info">
+<a class="title" href="{{.Href}}">{{.Title}}</a>
+{{- if .Subtitle}}<div class="subtitle">{{.Subtitle}}</div>{{end}}
+{{- if .Source}}<div class="source"><a class="source" href="{{.Source}}">original page</a></div>{{end}}
+{{- if .Tags}}<div class="tags">{{range .Tags}}<a href="#" data-filter="{{tagFilter .}}">{{.}}</a>{{end}}</div>{{end}}
+</div>
+</div>
+{{- end}}
+</main>
+<script>
+(function () {
+  var input = document.getElementById("filter");
+  var cards = document.querySelectorAll(".card");
+
+  function apply() {
+    var terms = input.value.toLowerCase().split(/\s+/).filter(Boolean);
+    cards.forEach(function (card) {
+      var search = card.getAttribute("data-search");
+      var tags = card.getAttribute("data-tags").split(" ");
+      var match = terms.every(function (term) {
+        if (term.indexOf("tag:") === 0) {
+          return tags.indexOf(term) >= 0;
+        }
+        return search.indexOf(term) >= 0;
+      });
+      card.style.display = match ? "" : "none";
+    });
+    history.replaceState(null, "", input.value ? "#" + encodeURIComponent(input.value) : location.pathname);
+  }
+
+  document.addEventListener("click", function (event) {
+    var filter = event.target.getAttribute("data-filter");
+    if (filter) {
+      event.preventDefault();
+      input.value = filter;
+      apply();
+    }
+  });
+
+  input.addEventListener("input", apply);
+  if (location.hash.length > 1) {
+    input.value = decodeURIComponent(location.hash.slice(1));
+    apply();
+  }
+})();
+</script>
+</body>
+</html>
+`
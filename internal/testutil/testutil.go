@@ -0,0 +1,33 @@
+// Package testutil holds helpers shared by the tests of several
+// packages.
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// WriteFile writes the data to the file, creating its folders.
+func WriteFile(t *testing.T, fp string, data []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(fp), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// WriteFiles writes files into an output directory by their keys,
+// eg. "deviantart/one/a.jpg". Each file contains its own name.
+func WriteFiles(t *testing.T, directory string, keys ...string) {
+	t.Helper()
+
+	for _, key := range keys {
+		WriteFile(t, filepath.Join(directory, filepath.FromSlash(key)), []byte(path.Base(key)))
+	}
+}
@@ -0,0 +1,241 @@
+package processors
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif" // register decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/bmp"  // register decoder
+	_ "golang.org/x/image/tiff" // register decoder
+	_ "golang.org/x/image/webp" // register decoder
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+const (
+	defaultQuality int    = 90
+	defaultSources string = "webp,bmp,tiff"
+)
+
+// ConvertProcessor re-encodes images in formats that common viewers
+// can't open into PNG or JPEG.
+type ConvertProcessor struct {
+	format  string
+	quality int
+	keep    bool
+	sources []string
+}
+
+// NewConvert creates a processor that converts image formats.
+//
+// The `format` option is the target format, either "png" or
+// "jpg". The `quality` option sets the JPEG quality from 1 to
+// 100. The `from` option is a comma separated list of types
+// to convert, by default WebP, BMP and TIFF. When the `keep`
+// option is "true" the original file is kept next to the
+// converted one, otherwise it's deleted.
+func NewConvert(session *artdl.Session, options map[string]string) (artdl.Processor, error) {
+	p := &ConvertProcessor{
+		format:  artdl.NormalizeType(options["format"]),
+		quality: defaultQuality,
+		keep:    options["keep"] == "true",
+	}
+
+	switch p.format {
+	case "":
+		p.format = "png"
+	case "png", "jpg":
+	default:
+		return nil, fmt.Errorf("unsupported format '%s'", options["format"])
+	}
+
+	if q, ok := options["quality"]; ok {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("quality must be between 1 and 100")
+		}
+		p.quality = quality
+	}
+
+	sources := options["from"]
+	if sources == "" {
+		sources = defaultSources
+	}
+	for _, t := range strings.Split(sources, ",") {
+		if t = artdl.NormalizeType(t); t != "" && t != p.format {
+			p.sources = append(p.sources, t)
+		}
+	}
+
+	return p, nil
+}
+
+// Name returns a descriptive name for the processor.
+func (p *ConvertProcessor) Name() string {
+	return "convert"
+}
+
+// Process decodes the file and writes it in the target format,
+// next to the original. A file already at the converted name is
+// never replaced, the converted file is numbered instead.
+func (p *ConvertProcessor) Process(fp string, asset *artdl.Asset) (string, error) {
+	if !p.accepts(fileType(fp, asset)) {
+		return fp, nil
+	}
+
+	img, err := decodeImage(fp)
+	if err != nil {
+		return fp, err
+	}
+
+	dst := strings.TrimSuffix(fp, filepath.Ext(fp)) + "." + p.format
+
+	// A misnamed file, eg. WebP content in a .png, is
+	// replaced by its conversion.
+	if dst != fp || p.keep {
+		dst = freeFilename(dst)
+	}
+
+	err = writeImage(dst, fp, func(file *os.File) error {
+		if p.format == "jpg" {
+			return jpeg.Encode(file, img, &jpeg.Options{Quality: p.quality})
+		}
+		return png.Encode(file, img)
+	})
+	if err != nil {
+		return fp, err
+	}
+
+	if !p.keep && dst != fp {
+		if err := os.Remove(fp); err != nil {
+			return dst, err
+		}
+	}
+
+	return dst, nil
+}
+
+func (p *ConvertProcessor) accepts(t string) bool {
+	for _, source := range p.sources {
+		if source == t {
+			return true
+		}
+	}
+	return false
+}
+
+// fileType tells the type of a file from its first bytes, since
+// sites don't always serve files with the extension of their
+// content. Types that can't be sniffed, like TIFF, fall back to
+// the asset's type, then the file extension.
+func fileType(fp string, asset *artdl.Asset) string {
+	if t := sniffType(fp); t != "" {
+		return t
+	}
+
+	if t := asset.Type(); t != "" {
+		return t
+	}
+
+	return artdl.NormalizeType(filepath.Ext(fp))
+}
+
+// sniffType returns the type of an image file by its content, or
+// an empty string when it's not a known image type.
+func sniffType(fp string) string {
+	file, err := os.Open(fp)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	// Content detection considers at most 512 bytes
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ""
+	}
+
+	contentType := http.DetectContentType(buf[:n])
+	if !strings.HasPrefix(contentType, "image/") {
+		return ""
+	}
+
+	return artdl.NormalizeType(strings.TrimPrefix(contentType, "image/"))
+}
+
+// freeFilename returns the path, or when a file already exists
+// there, the first numbered variant that doesn't exist, eg.
+// "image_2.png".
+func freeFilename(fp string) string {
+	ext := filepath.Ext(fp)
+	base := strings.TrimSuffix(fp, ext)
+
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(fp); os.IsNotExist(err) {
+			return fp
+		}
+		fp = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// decodeImage reads an image in any of the registered formats.
+func decodeImage(fp string) (image.Image, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode '%s': %s", fp, err)
+	}
+
+	return img, nil
+}
+
+// writeImage encodes an image into the destination file using a
+// temporary file, so a failed encode never leaves a broken file.
+// The modification time is copied from the source file.
+func writeImage(dst string, src string, encode func(file *os.File) error) error {
+	// Stat before writing, since the source may be replaced
+	stat, statErr := os.Stat(src)
+
+	tfp := filepath.Join(filepath.Dir(dst), artdl.TempFilename(filepath.Base(dst)))
+
+	// Close file before rename, because Windows locks
+	// the file handle.
+	err := func() error {
+		file, err := os.Create(tfp)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return encode(file)
+	}()
+
+	if err != nil {
+		_ = os.Remove(tfp)
+		return err
+	}
+
+	if err := os.Rename(tfp, dst); err != nil {
+		return err
+	}
+
+	if statErr == nil {
+		_ = os.Chtimes(dst, stat.ModTime(), stat.ModTime())
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package processors
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/bmp"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+func TestConvert(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	src := filepath.Join(dir, "image.bmp")
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bmp.Encode(file, image.NewRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	p, err := NewConvert(nil, map[string]string{"format": "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	dst, err := p.Process(src, &artdl.Asset{})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(dir, "image.png")
+	if dst != expected {
+		t.Fatalf("Expected %s, actual %s", expected, dst)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("Expected original to be removed")
+	}
+
+	file, err = os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cfg, err := png.DecodeConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 8 || cfg.Height != 4 {
+		t.Fatalf("Expected 8x4, actual %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestConvertIgnoresOtherTypes(t *testing.T) {
+	// Arrange
+	p, err := NewConvert(nil, map[string]string{"format": "jpg", "quality": "80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	fp, err := p.Process("image.png", &artdl.Asset{})
+
+	// Assert
+	if err != nil || fp != "image.png" {
+		t.Fatalf("Expected file to be left alone, actual %s, %v", fp, err)
+	}
+}
+
+func TestConvertSniffsContent(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	src := filepath.Join(dir, "image.png")
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bmp.Encode(file, image.NewRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	p, err := NewConvert(nil, map[string]string{"format": "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	dst, err := p.Process(src, &artdl.Asset{})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst != src {
+		t.Fatalf("Expected %s, actual %s", src, dst)
+	}
+
+	file, err = os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := png.DecodeConfig(file); err != nil {
+		t.Fatalf("Expected PNG content: %s", err)
+	}
+}
+
+func TestConvertKeepsExistingFile(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	src := filepath.Join(dir, "image.bmp")
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bmp.Encode(file, image.NewRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	existing := filepath.Join(dir, "image.png")
+	if err := ioutil.WriteFile(existing, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewConvert(nil, map[string]string{"format": "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	dst, err := p.Process(src, &artdl.Asset{})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(dir, "image_2.png")
+	if dst != expected {
+		t.Fatalf("Expected %s, actual %s", expected, dst)
+	}
+
+	b, err := ioutil.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "other" {
+		t.Fatalf("Expected existing file to be left alone, actual %q", b)
+	}
+}
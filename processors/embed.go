@@ -0,0 +1,541 @@
+package processors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+const (
+	exifHeader string = "Exif\x00\x00"
+	xmpHeader  string = "http://ns.adobe.com/xap/1.0/\x00"
+
+	// xmpKeyword is the iTXt keyword of XMP packets in PNG files
+	xmpKeyword string = "XML:com.adobe.xmp"
+
+	// maxSegmentLength is the largest payload of a JPEG segment,
+	// after its length field.
+	maxSegmentLength int = 0xFFFF - 2
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// EmbedProcessor writes the artist, title, source URL, site,
+// publish date and tags of the artwork into the file itself, so
+// they stay with it when it's shared.
+//
+// JPEG files get an EXIF and an XMP segment, and PNG files get
+// iTXt chunks. Pixel data is copied as is, and metadata already
+// in the file is kept: existing fields aren't overwritten.
+type EmbedProcessor struct{}
+
+// NewEmbed creates a processor that embeds metadata in images.
+// It has no options.
+func NewEmbed(session *artdl.Session, options map[string]string) (artdl.Processor, error) {
+	return &EmbedProcessor{}, nil
+}
+
+// Name returns a descriptive name for the processor.
+func (p *EmbedProcessor) Name() string {
+	return "embed"
+}
+
+// Process rewrites the file with the metadata embedded. Files
+// other than JPEG and PNG are left alone.
+func (p *EmbedProcessor) Process(fp string, asset *artdl.Asset) (string, error) {
+	var embed func(data []byte, meta *embeddedMetadata) ([]byte, error)
+
+	switch artdl.NormalizeType(filepath.Ext(fp)) {
+	case "jpg":
+		embed = embedJPEG
+	case "png":
+		embed = embedPNG
+	default:
+		return fp, nil
+	}
+
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return fp, err
+	}
+
+	result, err := embed(data, newEmbeddedMetadata(asset))
+	if err != nil {
+		return fp, fmt.Errorf("failed to embed metadata in '%s': %s", fp, err)
+	}
+
+	if bytes.Equal(data, result) {
+		return fp, nil
+	}
+
+	err = writeImage(fp, fp, func(file *os.File) error {
+		_, err := file.Write(result)
+		return err
+	})
+	if err != nil {
+		return fp, err
+	}
+
+	return fp, nil
+}
+
+// embeddedMetadata holds the fields written into files.
+type embeddedMetadata struct {
+	creator   string
+	title     string
+	source    string
+	site      string
+	published time.Time
+	keywords  []string
+}
+
+func newEmbeddedMetadata(asset *artdl.Asset) *embeddedMetadata {
+	source := asset.PageURL
+	if source == "" {
+		source = asset.URL
+	}
+
+	return &embeddedMetadata{
+		creator:   asset.User,
+		title:     asset.Title,
+		source:    source,
+		site:      asset.Site,
+		published: asset.Published,
+		keywords:  asset.Tags,
+	}
+}
+
+// embedJPEG inserts EXIF and XMP segments after the JFIF header
+// of a JPEG file. An existing EXIF segment is kept as is, and
+// an existing XMP packet is given only the fields it lacks.
+func embedJPEG(data []byte, meta *embeddedMetadata) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG file")
+	}
+
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	hasExif, hasXMP := false, false
+	for _, s := range segments {
+		if s.marker != 0xE1 {
+			continue
+		}
+		hasExif = hasExif || bytes.HasPrefix(s.payload(data), []byte(exifHeader))
+		hasXMP = hasXMP || bytes.HasPrefix(s.payload(data), []byte(xmpHeader))
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:2])
+
+	inserted := false
+	insert := func() error {
+		if !hasExif {
+			if err := writeJPEGSegment(&out, 0xE1, append([]byte(exifHeader), buildExif(meta)...)); err != nil {
+				return err
+			}
+		}
+		if !hasXMP {
+			if err := writeJPEGSegment(&out, 0xE1, append([]byte(xmpHeader), buildXMP(meta)...)); err != nil {
+				return err
+			}
+		}
+		inserted = true
+		return nil
+	}
+
+	for _, s := range segments {
+		// JFIF requires its header first, and EXIF
+		// readers expect their segment next.
+		leading := s.marker == 0xE0 || (s.marker == 0xE1 && bytes.HasPrefix(s.payload(data), []byte(exifHeader)))
+		if !inserted && !leading {
+			if err := insert(); err != nil {
+				return nil, err
+			}
+		}
+
+		payload := s.payload(data)
+		if s.marker == 0xE1 && bytes.HasPrefix(payload, []byte(xmpHeader)) {
+			packet := mergeXMP(payload[len(xmpHeader):], meta)
+			if len(xmpHeader)+len(packet) <= maxSegmentLength {
+				if err := writeJPEGSegment(&out, 0xE1, append([]byte(xmpHeader), packet...)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		out.Write(data[s.start:s.end])
+	}
+
+	if !inserted {
+		if err := insert(); err != nil {
+			return nil, err
+		}
+	}
+
+	out.Write(data[scan:])
+
+	return out.Bytes(), nil
+}
+
+// jpegSegment is a marker segment of a JPEG file, from its
+// marker to the end of its payload.
+type jpegSegment struct {
+	marker     byte
+	start, end int
+}
+
+func (s *jpegSegment) payload(data []byte) []byte {
+	if s.end-s.start < 4 {
+		return nil
+	}
+	return data[s.start+4 : s.end]
+}
+
+// jpegSegments lists the segments between the start of image and
+// the start of the scan, and returns the offset of the scan.
+func jpegSegments(data []byte) ([]jpegSegment, int, error) {
+	segments := make([]jpegSegment, 0)
+	pos := 2
+
+	for {
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, 0, errors.New("malformed JPEG segment")
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte
+			pos++
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			return segments, pos, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			segments = append(segments, jpegSegment{marker: marker, start: pos, end: pos + 2})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, 0, errors.New("truncated JPEG segment")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, errors.New("truncated JPEG segment")
+		}
+
+		segments = append(segments, jpegSegment{marker: marker, start: pos, end: end})
+		pos = end
+	}
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, payload []byte) error {
+	if len(payload) > maxSegmentLength {
+		return fmt.Errorf("metadata of %d bytes doesn't fit in a segment", len(payload))
+	}
+
+	out.Write([]byte{0xFF, marker})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+
+	return nil
+}
+
+// buildExif encodes a little endian TIFF header with a single
+// IFD holding the title, date and artist.
+func buildExif(meta *embeddedMetadata) []byte {
+	type entry struct {
+		tag   uint16
+		value string
+	}
+
+	entries := make([]entry, 0, 3)
+	if meta.title != "" {
+		entries = append(entries, entry{0x010E, meta.title}) // ImageDescription
+	}
+	if !meta.published.IsZero() {
+		entries = append(entries, entry{0x0132, meta.published.Format("2006:01:02 15:04:05")}) // DateTime
+	}
+	if meta.creator != "" {
+		entries = append(entries, entry{0x013B, meta.creator}) // Artist
+	}
+
+	order := binary.LittleEndian
+	ifdSize := 2 + 12*len(entries) + 4
+	values := make([]byte, 0)
+
+	var out bytes.Buffer
+	out.WriteString("II")
+	binary.Write(&out, order, uint16(42))
+	binary.Write(&out, order, uint32(8))
+	binary.Write(&out, order, uint16(len(entries)))
+
+	for _, e := range entries {
+		value := append([]byte(e.value), 0)
+
+		binary.Write(&out, order, e.tag)
+		binary.Write(&out, order, uint16(2)) // ASCII
+		binary.Write(&out, order, uint32(len(value)))
+
+		if len(value) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, value)
+			out.Write(inline)
+		} else {
+			binary.Write(&out, order, uint32(8+ifdSize+len(values)))
+			values = append(values, value...)
+		}
+	}
+
+	// No further IFDs
+	binary.Write(&out, order, uint32(0))
+	out.Write(values)
+
+	return out.Bytes()
+}
+
+// embedPNG inserts iTXt chunks before the image data of a PNG
+// file. Text keywords already in the file are kept as is, and
+// an existing XMP packet is given only the fields it lacks.
+func embedPNG(data []byte, meta *embeddedMetadata) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a PNG file")
+	}
+
+	type chunk struct {
+		kind       string
+		start, end int
+	}
+
+	chunks := make([]chunk, 0)
+	keywords := make(map[string]bool)
+
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+
+		kind := string(data[pos+4 : pos+8])
+		switch kind {
+		case "tEXt", "zTXt", "iTXt":
+			body := data[pos+8 : pos+8+length]
+			if i := bytes.IndexByte(body, 0); i >= 0 {
+				keywords[string(body[:i])] = true
+			}
+		}
+
+		chunks = append(chunks, chunk{kind: kind, start: pos, end: end})
+		pos = end
+
+		if kind == "IEND" {
+			break
+		}
+	}
+
+	texts := make([][2]string, 0, 4)
+	if meta.title != "" {
+		texts = append(texts, [2]string{"Title", meta.title})
+	}
+	if meta.creator != "" {
+		texts = append(texts, [2]string{"Author", meta.creator})
+	}
+	if !meta.published.IsZero() {
+		texts = append(texts, [2]string{"Creation Time", meta.published.UTC().Format(time.RFC1123)})
+	}
+	texts = append(texts, [2]string{xmpKeyword, string(buildXMP(meta))})
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+
+	inserted := false
+	for _, c := range chunks {
+		if !inserted && (c.kind == "IDAT" || c.kind == "IEND") {
+			for _, text := range texts {
+				if !keywords[text[0]] {
+					writePNGChunk(&out, "iTXt", buildITXt(text[0], text[1]))
+				}
+			}
+			inserted = true
+		}
+
+		if c.kind == "iTXt" {
+			if body, ok := mergeXMPChunk(data[c.start+8:c.end-4], meta); ok {
+				writePNGChunk(&out, "iTXt", body)
+				continue
+			}
+		}
+
+		out.Write(data[c.start:c.end])
+	}
+
+	return out.Bytes(), nil
+}
+
+// buildITXt encodes an uncompressed iTXt chunk without a language.
+func buildITXt(keyword, text string) []byte {
+	body := make([]byte, 0, len(keyword)+len(text)+5)
+	body = append(body, keyword...)
+	body = append(body, 0, 0, 0) // compression flag and method
+	body = append(body, 0)       // language tag
+	body = append(body, 0)       // translated keyword
+	body = append(body, text...)
+	return body
+}
+
+// mergeXMPChunk adds the missing fields to an uncompressed XMP
+// iTXt chunk. Returns false for any other chunk.
+func mergeXMPChunk(body []byte, meta *embeddedMetadata) ([]byte, bool) {
+	prefix := xmpKeyword + "\x00\x00"
+	if !bytes.HasPrefix(body, []byte(prefix)) {
+		return nil, false
+	}
+
+	// Skip compression method, language tag and translated keyword
+	rest := body[len(prefix)+1:]
+	for i := 0; i < 2; i++ {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return nil, false
+		}
+		rest = rest[end+1:]
+	}
+
+	header := body[:len(body)-len(rest)]
+	merged := mergeXMP(rest, meta)
+
+	return append(append([]byte{}, header...), merged...), true
+}
+
+func writePNGChunk(out *bytes.Buffer, kind string, body []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(body)))
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(body)
+
+	out.WriteString(kind)
+	out.Write(body)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+// xmpProperty is a field of the XMP packet, by its element name.
+type xmpProperty struct {
+	name    string
+	content string
+}
+
+// xmpProperties renders the fields of the metadata as XMP
+// properties, leaving out empty ones.
+func xmpProperties(meta *embeddedMetadata) []xmpProperty {
+	props := make([]xmpProperty, 0, 6)
+
+	if meta.creator != "" {
+		props = append(props, xmpProperty{"dc:creator", "<rdf:Seq><rdf:li>" + escapeXML(meta.creator) + "</rdf:li></rdf:Seq>"})
+	}
+	if meta.title != "" {
+		props = append(props, xmpProperty{"dc:title", `<rdf:Alt><rdf:li xml:lang="x-default">` + escapeXML(meta.title) + "</rdf:li></rdf:Alt>"})
+	}
+	if meta.source != "" {
+		props = append(props, xmpProperty{"dc:source", escapeXML(meta.source)})
+	}
+	if meta.site != "" {
+		props = append(props, xmpProperty{"dc:publisher", "<rdf:Bag><rdf:li>" + escapeXML(meta.site) + "</rdf:li></rdf:Bag>"})
+	}
+	if !meta.published.IsZero() {
+		props = append(props, xmpProperty{"xmp:CreateDate", meta.published.Format(time.RFC3339)})
+	}
+	if len(meta.keywords) > 0 {
+		var b strings.Builder
+		b.WriteString("<rdf:Bag>")
+		for _, keyword := range meta.keywords {
+			b.WriteString("<rdf:li>" + escapeXML(keyword) + "</rdf:li>")
+		}
+		b.WriteString("</rdf:Bag>")
+		props = append(props, xmpProperty{"dc:subject", b.String()})
+	}
+
+	return props
+}
+
+// xmpDescription renders properties as an rdf:Description element.
+func xmpDescription(props []xmpProperty) string {
+	var b strings.Builder
+
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/">`)
+	for _, prop := range props {
+		fmt.Fprintf(&b, "\n   <%s>%s</%s>", prop.name, prop.content, prop.name)
+	}
+	b.WriteString("\n  </rdf:Description>")
+
+	return b.String()
+}
+
+// buildXMP creates an XMP packet describing the artwork.
+func buildXMP(meta *embeddedMetadata) []byte {
+	var b strings.Builder
+
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n  ")
+	b.WriteString(xmpDescription(xmpProperties(meta)))
+	b.WriteString("\n </rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+
+	return []byte(b.String())
+}
+
+// mergeXMP adds the properties an existing packet lacks as another
+// rdf:Description element. The packet is returned unchanged when it
+// has all of them, or can't be extended.
+func mergeXMP(packet []byte, meta *embeddedMetadata) []byte {
+	end := bytes.LastIndex(packet, []byte("</rdf:RDF>"))
+	if end < 0 {
+		return packet
+	}
+
+	missing := make([]xmpProperty, 0)
+	for _, prop := range xmpProperties(meta) {
+		// Properties may be elements or attributes
+		if !bytes.Contains(packet, []byte("<"+prop.name)) && !bytes.Contains(packet, []byte(prop.name+"=")) {
+			missing = append(missing, prop)
+		}
+	}
+
+	if len(missing) == 0 {
+		return packet
+	}
+
+	merged := make([]byte, 0, len(packet)+512)
+	merged = append(merged, packet[:end]...)
+	merged = append(merged, "  "+xmpDescription(missing)+"\n "...)
+	merged = append(merged, packet[end:]...)
+
+	return merged
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
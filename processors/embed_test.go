@@ -0,0 +1,198 @@
+package processors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+func embedTestAsset() *artdl.Asset {
+	return &artdl.Asset{
+		Site:      "artstation",
+		User:      "one",
+		Title:     "Dragon & Knight",
+		PageURL:   "https://www.artstation.com/artwork/abc",
+		Published: time.Date(2019, 7, 19, 12, 30, 0, 0, time.UTC),
+		Tags:      []string{"concept", "dragon"},
+	}
+}
+
+func TestEmbedJPEG(t *testing.T) {
+	// Arrange
+	fp := filepath.Join(t.TempDir(), "image.jpg")
+	file, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(file, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	original, _ := ioutil.ReadFile(fp)
+
+	p, err := NewEmbed(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	result, err := p.Process(fp, embedTestAsset())
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != fp {
+		t.Fatalf("Expected %s, actual %s", fp, result)
+	}
+
+	data, _ := ioutil.ReadFile(fp)
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, original[len(original)-(len(data)-scan):]) {
+		t.Fatalf("Expected image data to be unchanged")
+	}
+
+	var exif, xmp []byte
+	for _, s := range segments {
+		payload := s.payload(data)
+		switch {
+		case bytes.HasPrefix(payload, []byte(exifHeader)):
+			exif = payload[len(exifHeader):]
+		case bytes.HasPrefix(payload, []byte(xmpHeader)):
+			xmp = payload[len(xmpHeader):]
+		}
+	}
+
+	if artist := exifString(t, exif, 0x013B); artist != "one" {
+		t.Fatalf("Expected %s, actual %s", "one", artist)
+	}
+	if date := exifString(t, exif, 0x0132); date != "2019:07:19 12:30:00" {
+		t.Fatalf("Expected %s, actual %s", "2019:07:19 12:30:00", date)
+	}
+	for _, expected := range []string{"Dragon &amp; Knight", "https://www.artstation.com/artwork/abc", "<rdf:li>dragon</rdf:li>"} {
+		if !bytes.Contains(xmp, []byte(expected)) {
+			t.Fatalf("Expected XMP to contain %s, actual %s", expected, xmp)
+		}
+	}
+
+	file, err = os.Open(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := jpeg.Decode(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmbedJPEGKeepsExistingXMP(t *testing.T) {
+	// Arrange
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Original</dc:title></rdf:Description>` +
+		`</rdf:RDF></x:xmpmeta>`
+	var data bytes.Buffer
+	data.Write(buf.Bytes()[:2])
+	if err := writeJPEGSegment(&data, 0xE1, append([]byte(xmpHeader), packet...)); err != nil {
+		t.Fatal(err)
+	}
+	data.Write(buf.Bytes()[2:])
+
+	// Act
+	result, err := embedJPEG(data.Bytes(), newEmbeddedMetadata(embedTestAsset()))
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(result, []byte(xmpHeader)); n != 1 {
+		t.Fatalf("Expected %d, actual %d", 1, n)
+	}
+	if !bytes.Contains(result, []byte("<dc:title>Original</dc:title>")) {
+		t.Fatalf("Expected existing title to be kept")
+	}
+	if bytes.Contains(result, []byte("Dragon &amp; Knight")) {
+		t.Fatalf("Expected existing title not to be overwritten")
+	}
+	if !bytes.Contains(result, []byte("<dc:creator>")) {
+		t.Fatalf("Expected missing creator to be added")
+	}
+}
+
+func TestEmbedPNG(t *testing.T) {
+	// Arrange
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	// Existing title, right after IHDR
+	var data bytes.Buffer
+	data.Write(buf.Bytes()[:33])
+	writePNGChunk(&data, "tEXt", []byte("Title\x00Original"))
+	data.Write(buf.Bytes()[33:])
+
+	// Act
+	result, err := embedPNG(data.Bytes(), newEmbeddedMetadata(embedTestAsset()))
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(result)); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(result, []byte("Title\x00")); n != 1 {
+		t.Fatalf("Expected %d, actual %d", 1, n)
+	}
+	for _, expected := range []string{"Author\x00\x00\x00\x00\x00one", xmpKeyword, "https://www.artstation.com/artwork/abc"} {
+		if !bytes.Contains(result, []byte(expected)) {
+			t.Fatalf("Expected PNG to contain %q", expected)
+		}
+	}
+	if idat := bytes.Index(result, []byte("IDAT")); idat < bytes.Index(result, []byte(xmpKeyword)) {
+		t.Fatalf("Expected text chunks before image data")
+	}
+}
+
+// exifString reads an ASCII field of the first IFD.
+func exifString(t *testing.T, tiff []byte, tag uint16) string {
+	t.Helper()
+
+	if len(tiff) < 10 || string(tiff[:2]) != "II" {
+		t.Fatalf("Expected little endian TIFF header")
+	}
+	order := binary.LittleEndian
+	ifd := int(order.Uint32(tiff[4:]))
+	count := int(order.Uint16(tiff[ifd:]))
+
+	for i := 0; i < count; i++ {
+		entry := tiff[ifd+2+12*i:]
+		if order.Uint16(entry) != tag {
+			continue
+		}
+		n := int(order.Uint32(entry[4:]))
+		value := entry[8:12]
+		if n > 4 {
+			offset := int(order.Uint32(entry[8:]))
+			value = tiff[offset : offset+n]
+		}
+		return string(bytes.TrimRight(value[:n], "\x00"))
+	}
+
+	return ""
+}
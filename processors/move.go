@@ -0,0 +1,59 @@
+package processors
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+// MoveProcessor moves downloaded files into another folder,
+// keeping their path relative to the output directory.
+type MoveProcessor struct {
+	root   string
+	target string
+}
+
+// NewMove creates a processor that moves files.
+//
+// The `to` option is the target folder. A relative
+// path is relative to the output directory.
+func NewMove(session *artdl.Session, options map[string]string) (artdl.Processor, error) {
+	target := options["to"]
+	if target == "" {
+		return nil, fmt.Errorf("option 'to' is required")
+	}
+
+	root := session.Config.Directory
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(root, target)
+	}
+
+	return &MoveProcessor{
+		root:   root,
+		target: target,
+	}, nil
+}
+
+// Name returns a descriptive name for the processor.
+func (p *MoveProcessor) Name() string {
+	return "move"
+}
+
+// Process moves the file into the target folder.
+func (p *MoveProcessor) Process(fp string, asset *artdl.Asset) (string, error) {
+	rel, err := filepath.Rel(p.root, fp)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		// Not in the output directory, so there's
+		// no structure to keep.
+		rel = filepath.Base(fp)
+	}
+
+	dst := filepath.Join(p.target, rel)
+	if err := artdl.MoveFile(fp, dst); err != nil {
+		return fp, err
+	}
+
+	return dst, nil
+}
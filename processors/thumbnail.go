@@ -0,0 +1,180 @@
+package processors
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	artdl "github.com/vangroan/art-dl/common"
+)
+
+const (
+	// ThumbsDirname is the name of the folder thumbnails are
+	// saved in, next to the images in each gallery.
+	ThumbsDirname string = ".thumbs"
+
+	// DefaultThumbnailSize is the default maximum edge length
+	// of thumbnails in pixels.
+	DefaultThumbnailSize int = 256
+
+	defaultThumbnailQuality int = 85
+)
+
+// thumbnailTypes are the image types thumbnails can be made of.
+var thumbnailTypes = []string{"jpg", "png", "gif", "webp", "bmp", "tiff"}
+
+// ThumbnailProcessor generates downscaled copies of images in a
+// `.thumbs` folder next to them.
+type ThumbnailProcessor struct {
+	size int
+}
+
+// NewThumbnail creates a processor that generates thumbnails.
+//
+// The `size` option is the maximum length of the longest
+// edge of a thumbnail in pixels, by default 256.
+func NewThumbnail(session *artdl.Session, options map[string]string) (artdl.Processor, error) {
+	size := DefaultThumbnailSize
+
+	if s, ok := options["size"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("size must be a positive number of pixels")
+		}
+		size = n
+	}
+
+	return NewThumbnailGenerator(size), nil
+}
+
+// NewThumbnailGenerator creates a thumbnail processor with the
+// given maximum edge length, for use outside a processor chain.
+func NewThumbnailGenerator(size int) *ThumbnailProcessor {
+	return &ThumbnailProcessor{size: size}
+}
+
+// Name returns a descriptive name for the processor.
+func (p *ThumbnailProcessor) Name() string {
+	return "thumbnail"
+}
+
+// Process generates a thumbnail for the file. The file
+// itself is left untouched.
+func (p *ThumbnailProcessor) Process(fp string, asset *artdl.Asset) (string, error) {
+	_, err := p.Generate(fp)
+	return fp, err
+}
+
+// Generate creates the thumbnail of an image, unless one exists
+// that is up to date. Files that aren't images are ignored.
+//
+// Returns true if a thumbnail was written.
+func (p *ThumbnailProcessor) Generate(fp string) (bool, error) {
+	if !IsThumbnailable(fp) {
+		return false, nil
+	}
+
+	stat, err := os.Stat(fp)
+	if err != nil {
+		return false, err
+	}
+
+	// Thumbnails get the modification time of their
+	// image, so any difference means it's outdated.
+	dst := ThumbnailPath(fp)
+	if thumb, err := os.Stat(dst); err == nil && thumb.ModTime().Equal(stat.ModTime()) {
+		return false, nil
+	}
+
+	img, err := decodeImage(fp)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return false, err
+	}
+
+	thumb := scaleDown(img, p.size)
+
+	err = writeImage(dst, fp, func(file *os.File) error {
+		if strings.HasSuffix(dst, ".png") {
+			return png.Encode(file, thumb)
+		}
+		return jpeg.Encode(file, thumb, &jpeg.Options{Quality: defaultThumbnailQuality})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ThumbnailPath returns where the thumbnail of an image is saved.
+// The thumbnail keeps the full file name of the image, so images
+// differing only by extension don't share one, eg. "a.webp" gets
+// ".thumbs/a.webp.jpg".
+//
+// Images that may have transparency get PNG thumbnails, the
+// rest get JPEG thumbnails.
+func ThumbnailPath(fp string) string {
+	dir, fn := filepath.Split(fp)
+
+	thumbExt := ".jpg"
+	switch artdl.NormalizeType(filepath.Ext(fn)) {
+	case "png", "gif":
+		thumbExt = ".png"
+	}
+
+	return filepath.Join(dir, ThumbsDirname, fn+thumbExt)
+}
+
+// IsThumbnailable checks whether a thumbnail can be made of the
+// file, based on its extension.
+func IsThumbnailable(fp string) bool {
+	t := artdl.NormalizeType(filepath.Ext(fp))
+	for _, accepted := range thumbnailTypes {
+		if accepted == t {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleDown resizes the image so its longest edge is at most the
+// given size, keeping the aspect ratio.
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+
+	return dst
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
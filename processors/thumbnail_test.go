@@ -0,0 +1,68 @@
+package processors
+
+import (
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbnailGenerate(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	src := filepath.Join(dir, "image.jpg")
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(file, image.NewRGBA(image.Rect(0, 0, 400, 100)), nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	generator := NewThumbnailGenerator(100)
+
+	// Act
+	first, err := generator.Generate(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := generator.Generate(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if !first || second {
+		t.Fatalf("Expected thumbnail to be generated once, actual %t, %t", first, second)
+	}
+
+	dst := filepath.Join(dir, ThumbsDirname, "image.jpg.jpg")
+	file, err = os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cfg, err := jpeg.DecodeConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 100 || cfg.Height != 25 {
+		t.Fatalf("Expected 100x25, actual %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestThumbnailPath(t *testing.T) {
+	cases := map[string]string{
+		filepath.Join("a", "b.png"):  filepath.Join("a", ThumbsDirname, "b.png.png"),
+		filepath.Join("a", "b.webp"): filepath.Join("a", ThumbsDirname, "b.webp.jpg"),
+		filepath.Join("a", "b.jpg"):  filepath.Join("a", ThumbsDirname, "b.jpg.jpg"),
+	}
+
+	for input, expected := range cases {
+		if actual := ThumbnailPath(input); actual != expected {
+			t.Fatalf("Expected %s, actual %s", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Package reorganize moves the files of an archive into a new
+// path layout.
+//
+// The planned moves are written to a journal before any file is
+// touched. Whether a move is done is told by the files on disk, so
+// an interrupted run can be resumed or undone from its journal.
+package reorganize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/processors"
+)
+
+// JournalFilename is the name of the journal created in the root
+// of the output directory while it's reorganized.
+const JournalFilename string = ".art-dl-reorganize.json"
+
+// Move is a file moved from one path to another, relative to the
+// output directory using forward slashes.
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Tracked moves are of files in the manifest, rather than
+	// their sidecars and thumbnails.
+	Tracked bool `json:"tracked,omitempty"`
+}
+
+// Skip is a file in the manifest that is left where it is.
+type Skip struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// Journal holds the moves of a reorganization.
+type Journal struct {
+	Template string    `json:"template"`
+	Link     bool      `json:"link,omitempty"`
+	Started  time.Time `json:"started"`
+	Moves    []Move    `json:"moves"`
+	Skipped  []Skip    `json:"skipped,omitempty"`
+
+	directory string
+}
+
+// Plan lays out the files in the manifest with the template. Files
+// keep their current extension, since processors may have converted
+// them. Removed duplicates are left out, and missing files and
+// adopted files without a URL are left in place, listed in the
+// journal's skipped files.
+//
+// Per file sidecars move with their files. They and per folder
+// sidecars are updated with the new paths when the journal is
+// applied.
+//
+// Fails when two files would end up at the same path, or a file
+// would replace one that exists.
+//
+// Linked files are hardlinked into the new layout, keeping the old
+// one in place.
+func Plan(directory string, manifest *artdl.Manifest, catalog *artdl.Catalog, template *artdl.PathTemplate, link bool) (*Journal, error) {
+	j := &Journal{
+		Template:  template.String(),
+		Link:      link,
+		Started:   time.Now(),
+		Moves:     make([]Move, 0),
+		directory: directory,
+	}
+
+	targets := make(map[string]string)
+
+	for _, entry := range manifest.Entries() {
+		if entry.DuplicateOf != "" {
+			continue
+		}
+		if entry.URL == "" {
+			j.Skipped = append(j.Skipped, Skip{Path: entry.Path, Reason: "adopted but not matched to an asset yet"})
+			continue
+		}
+		if _, err := os.Stat(j.local(entry.Path)); err != nil {
+			j.Skipped = append(j.Skipped, Skip{Path: entry.Path, Reason: err.Error()})
+			continue
+		}
+
+		to, err := template.Execute(entryAsset(entry, catalog))
+		if err != nil {
+			return nil, err
+		}
+		if ext := path.Ext(entry.Path); path.Ext(to) != ext {
+			to = strings.TrimSuffix(to, path.Ext(to)) + ext
+		}
+		if to == entry.Path {
+			continue
+		}
+
+		moves := []Move{{From: entry.Path, To: to, Tracked: true}}
+
+		// Sidecars and thumbnails follow their file
+		if _, err := os.Stat(j.local(entry.Path + artdl.SidecarSuffix)); err == nil {
+			moves = append(moves, Move{From: entry.Path + artdl.SidecarSuffix, To: to + artdl.SidecarSuffix})
+		}
+		if processors.IsThumbnailable(entry.Path) {
+			thumb := processors.ThumbnailPath(entry.Path)
+			if _, err := os.Stat(j.local(thumb)); err == nil {
+				moves = append(moves, Move{From: thumb, To: processors.ThumbnailPath(to)})
+			}
+		}
+
+		for _, move := range moves {
+			if other, ok := targets[move.To]; ok {
+				return nil, fmt.Errorf("both '%s' and '%s' would move to '%s'", other, move.From, move.To)
+			}
+			if _, err := os.Stat(j.local(move.To)); err == nil {
+				return nil, fmt.Errorf("can't move '%s' to '%s', which already exists", move.From, move.To)
+			}
+			targets[move.To] = move.From
+		}
+
+		j.Moves = append(j.Moves, moves...)
+	}
+
+	return j, nil
+}
+
+// entryAsset rebuilds the asset of a manifest entry, with the
+// artwork details from the catalog when it has them.
+func entryAsset(entry artdl.ManifestEntry, catalog *artdl.Catalog) *artdl.Asset {
+	asset := &artdl.Asset{
+		URL:    entry.URL,
+		Site:   entry.Site,
+		User:   entry.User,
+		Width:  entry.Width,
+		Height: entry.Height,
+	}
+
+	record, ok := catalog.FindURL(entry.URL)
+	if !ok {
+		return asset
+	}
+	asset.Index = record.Index
+	asset.ContentType = record.ContentType
+
+	if artwork, ok := catalog.Artwork(record.Artwork); ok {
+		asset.ArtworkID = artwork.ID
+		asset.Title = artwork.Title
+		asset.Description = artwork.Description
+		asset.Tags = artwork.Tags
+		asset.PageURL = artwork.PageURL
+		asset.Published = artwork.Published
+	}
+
+	return asset
+}
+
+// LoadJournal reads the journal of an interrupted reorganization.
+// Returns `ErrNotExist` if there is none.
+func LoadJournal(directory string) (*Journal, error) {
+	fp := filepath.Join(directory, JournalFilename)
+
+	b, err := ioutil.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return nil, artdl.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %s", err)
+	}
+
+	j := &Journal{directory: directory}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("failed to parse journal '%s': %s", fp, err)
+	}
+
+	return j, nil
+}
+
+// Save writes the journal, through a temporary file so it's never
+// left half written.
+func (j *Journal) Save() error {
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fp := filepath.Join(j.directory, JournalFilename)
+	tfp := filepath.Join(j.directory, artdl.TempFilename(JournalFilename))
+	if err := ioutil.WriteFile(tfp, b, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %s", err)
+	}
+
+	return os.Rename(tfp, fp)
+}
+
+// Apply moves or links the files, skipping moves that are already
+// done, then updates the manifest, catalog and per folder sidecars
+// and removes the journal. The journal must be saved beforehand.
+func (j *Journal) Apply(manifest *artdl.Manifest, catalog *artdl.Catalog) error {
+	for _, move := range j.Moves {
+		if err := j.apply(move); err != nil {
+			return fmt.Errorf("failed to move '%s' to '%s': %s", move.From, move.To, err)
+		}
+	}
+
+	paths := make(map[string]string)
+	for _, move := range j.Moves {
+		if move.Tracked {
+			manifest.Move(move.From, move.To)
+			paths[move.From] = move.To
+		}
+	}
+
+	if err := j.finish(manifest, catalog, paths, j.Link); err != nil {
+		return err
+	}
+
+	if !j.Link {
+		j.removeEmptyDirs(func(move Move) string { return move.From })
+	}
+
+	return nil
+}
+
+// Undo moves the files back, or removes their links, then restores
+// the manifest, catalog and per folder sidecars and removes the
+// journal.
+func (j *Journal) Undo(manifest *artdl.Manifest, catalog *artdl.Catalog) error {
+	for i := len(j.Moves) - 1; i >= 0; i-- {
+		if err := j.undo(j.Moves[i]); err != nil {
+			return fmt.Errorf("failed to move '%s' back to '%s': %s", j.Moves[i].To, j.Moves[i].From, err)
+		}
+	}
+
+	// The manifest may have been saved before the run was
+	// interrupted, in which case the moves are reverted.
+	paths := make(map[string]string)
+	for _, move := range j.Moves {
+		if move.Tracked {
+			manifest.Move(move.To, move.From)
+			paths[move.To] = move.From
+		}
+	}
+
+	// Linked files were never taken out of their old sidecars
+	if err := j.finish(manifest, catalog, paths, false); err != nil {
+		return err
+	}
+
+	j.removeEmptyDirs(func(move Move) string { return move.To })
+
+	return nil
+}
+
+// finish saves the manifest and catalog, updates the paths in per
+// file sidecars and moves the entries of per folder sidecars to the
+// new paths, then removes the journal.
+// The old entries are kept when keep is set.
+func (j *Journal) finish(manifest *artdl.Manifest, catalog *artdl.Catalog, paths map[string]string, keep bool) error {
+	if err := manifest.Save(); err != nil {
+		return err
+	}
+
+	if err := catalog.Moved(paths); err != nil {
+		return err
+	}
+
+	storage := artdl.NewLocalStorage(j.directory)
+	if err := artdl.MoveFileSidecars(storage, paths); err != nil {
+		return err
+	}
+	if err := artdl.MoveProjectSidecars(storage, paths, keep); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(j.directory, JournalFilename))
+}
+
+func (j *Journal) apply(move Move) error {
+	src, dst := j.local(move.From), j.local(move.To)
+
+	_, srcErr := os.Stat(src)
+	dstInfo, dstErr := os.Stat(dst)
+
+	if j.Link {
+		if dstErr == nil {
+			srcInfo, err := os.Stat(src)
+			if err == nil && os.SameFile(srcInfo, dstInfo) {
+				return nil
+			}
+			return fmt.Errorf("destination already exists")
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		return os.Link(src, dst)
+	}
+
+	if os.IsNotExist(srcErr) && dstErr == nil {
+		return nil
+	}
+	if dstErr == nil {
+		return fmt.Errorf("destination already exists")
+	}
+
+	return artdl.MoveFile(src, dst)
+}
+
+func (j *Journal) undo(move Move) error {
+	src, dst := j.local(move.From), j.local(move.To)
+
+	srcInfo, srcErr := os.Stat(src)
+	dstInfo, dstErr := os.Stat(dst)
+
+	if os.IsNotExist(dstErr) {
+		return nil
+	}
+
+	if j.Link {
+		if srcErr == nil && os.SameFile(srcInfo, dstInfo) {
+			return os.Remove(dst)
+		}
+		return nil
+	}
+
+	if srcErr == nil {
+		return fmt.Errorf("'%s' already exists", move.From)
+	}
+
+	return artdl.MoveFile(dst, src)
+}
+
+// removeEmptyDirs removes the folders left empty by the moves,
+// up to the output directory.
+func (j *Journal) removeEmptyDirs(key func(move Move) string) {
+	root := filepath.Clean(j.directory)
+
+	for _, move := range j.Moves {
+		dir := filepath.Dir(j.local(key(move)))
+		for dir != root && strings.HasPrefix(dir, root) {
+			// Fails on folders that still have files
+			if err := os.Remove(dir); err != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+}
+
+// local returns the path of a key on disk.
+func (j *Journal) local(key string) string {
+	return filepath.Join(j.directory, filepath.FromSlash(key))
+}
@@ -0,0 +1,318 @@
+package reorganize
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/internal/testutil"
+	"github.com/vangroan/art-dl/processors"
+)
+
+// newArchive creates an archive with two files of an artwork in the
+// manifest and catalog, laid out as site/user/filename.
+func newArchive(t *testing.T) (string, *artdl.Manifest, *artdl.Catalog) {
+	t.Helper()
+
+	dir := t.TempDir()
+	manifest, err := artdl.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := artdl.OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { catalog.Close() })
+
+	testutil.WriteFiles(t, dir, "artstation/one/a.jpg", "artstation/one/b.jpg")
+	testutil.WriteFile(t, filepath.Join(dir, "artstation", "one", "a.jpg"+artdl.SidecarSuffix), []byte("{}"))
+	testutil.WriteFile(t, processors.ThumbnailPath(filepath.Join(dir, "artstation", "one", "a.jpg")), []byte("thumb"))
+
+	published := time.Date(2019, 7, 19, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a.jpg", "b.jpg"} {
+		key := "artstation/one/" + name
+		asset := artdl.Asset{
+			URL:       "https://example.com/" + name,
+			Site:      "artstation",
+			User:      "one",
+			ArtworkID: "42",
+			Index:     i + 1,
+			Title:     "Dragon",
+			Published: published,
+		}
+		if err := catalog.Seen(&asset); err != nil {
+			t.Fatal(err)
+		}
+		if err := catalog.Stored(asset.URL, key, 5, "abcd"); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Add(artdl.ManifestEntry{Path: key, URL: asset.URL, Site: "artstation", User: "one"})
+	}
+
+	if err := manifest.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, manifest, catalog
+}
+
+func planArchive(t *testing.T, dir string, manifest *artdl.Manifest, catalog *artdl.Catalog) *Journal {
+	t.Helper()
+
+	template, err := artdl.ParsePathTemplate("{site}/{user}/{date:2006}/{title}_{index}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal, err := Plan(dir, manifest, catalog, template, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return journal
+}
+
+func TestApply(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	journal := planArchive(t, dir, manifest, catalog)
+
+	// Act
+	err := journal.Apply(manifest, catalog)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"Dragon_1.jpg", "Dragon_1.jpg" + artdl.SidecarSuffix, "Dragon_2.jpg", filepath.Join(processors.ThumbsDirname, "Dragon_1.jpg.jpg")} {
+		if _, err := os.Stat(filepath.Join(dir, "artstation", "one", "2019", key)); err != nil {
+			t.Fatalf("Expected %s to be moved: %s", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "artstation", "one", "a.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("Expected a.jpg to be moved away")
+	}
+	if _, err := os.Stat(filepath.Join(dir, JournalFilename)); !os.IsNotExist(err) {
+		t.Fatalf("Expected journal to be removed")
+	}
+
+	saved, err := artdl.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := saved.FindURL("https://example.com/a.jpg"); !ok || entry.Path != "artstation/one/2019/Dragon_1.jpg" {
+		t.Fatalf("Expected manifest entry to be moved, actual %+v", entry)
+	}
+	if record, ok := catalog.FindURL("https://example.com/b.jpg"); !ok || record.Path != "artstation/one/2019/Dragon_2.jpg" {
+		t.Fatalf("Expected catalog path to be moved, actual %+v", record)
+	}
+}
+
+func TestResume(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	planArchive(t, dir, manifest, catalog)
+
+	// Interrupted after the first move
+	err := artdl.MoveFile(filepath.Join(dir, "artstation", "one", "a.jpg"), filepath.Join(dir, "artstation", "one", "2019", "Dragon_1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	journal, err := LoadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Apply(manifest, catalog)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "artstation", "one", "2019", "*.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected %d files, actual %d", 2, len(files))
+	}
+}
+
+func TestUndo(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	planArchive(t, dir, manifest, catalog)
+
+	// Interrupted after the first move
+	err := artdl.MoveFile(filepath.Join(dir, "artstation", "one", "a.jpg"), filepath.Join(dir, "artstation", "one", "2019", "Dragon_1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	journal, err := LoadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Undo(manifest, catalog)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, "artstation", "one", name)); err != nil {
+			t.Fatalf("Expected %s to be back: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "artstation", "one", "2019")); !os.IsNotExist(err) {
+		t.Fatalf("Expected new folder to be removed")
+	}
+	if _, ok := manifest.Get("artstation/one/a.jpg"); !ok {
+		t.Fatalf("Expected manifest entry to stay")
+	}
+}
+
+func TestPlanConflict(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	template, err := artdl.ParsePathTemplate("{site}/{user}/{title}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	_, err = Plan(dir, manifest, catalog, template, false)
+
+	// Assert
+	if err == nil {
+		t.Fatalf("Expected files moving to the same path to fail")
+	}
+}
+
+func TestApplyProjectSidecar(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	data := struct {
+		Artworks []*artdl.Sidecar `json:"artworks"`
+	}{[]*artdl.Sidecar{{
+		Site:      "artstation",
+		User:      "one",
+		ArtworkID: "42",
+		Files: []artdl.SidecarFile{
+			{Path: "artstation/one/a.jpg", URL: "https://example.com/a.jpg", Index: 1},
+			{Path: "artstation/one/b.jpg", URL: "https://example.com/b.jpg", Index: 2},
+		},
+	}}}
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(dir, "artstation", "one", artdl.ProjectSidecarFilename), b)
+	journal := planArchive(t, dir, manifest, catalog)
+
+	// Act
+	err = journal.Apply(manifest, catalog)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "artstation", "one", artdl.ProjectSidecarFilename)); !os.IsNotExist(err) {
+		t.Fatalf("Expected old folder sidecar to be removed")
+	}
+
+	sidecars, err := artdl.LoadSidecars(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]bool)
+	for _, sidecar := range sidecars {
+		for _, file := range sidecar.Files {
+			paths[file.Path] = true
+		}
+	}
+	for _, key := range []string{"artstation/one/2019/Dragon_1.jpg", "artstation/one/2019/Dragon_2.jpg"} {
+		if !paths[key] {
+			t.Fatalf("Expected folder sidecar to list %s, actual %v", key, paths)
+		}
+	}
+}
+
+func TestApplyFileSidecar(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	sidecar := artdl.Sidecar{
+		Site:      "artstation",
+		User:      "one",
+		ArtworkID: "42",
+		Files:     []artdl.SidecarFile{{Path: "artstation/one/a.jpg", URL: "https://example.com/a.jpg", Index: 1}},
+	}
+	b, err := json.Marshal(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(dir, "artstation", "one", "a.jpg"+artdl.SidecarSuffix), b)
+	journal := planArchive(t, dir, manifest, catalog)
+
+	readPath := func(key string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sidecar artdl.Sidecar
+		if err := json.Unmarshal(b, &sidecar); err != nil {
+			t.Fatal(err)
+		}
+		return sidecar.Files[0].Path
+	}
+
+	// Act
+	if err := journal.Apply(manifest, catalog); err != nil {
+		t.Fatal(err)
+	}
+	applied := readPath("artstation/one/2019/Dragon_1.jpg" + artdl.SidecarSuffix)
+	if err := journal.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Undo(manifest, catalog); err != nil {
+		t.Fatal(err)
+	}
+	undone := readPath("artstation/one/a.jpg" + artdl.SidecarSuffix)
+
+	// Assert
+	if applied != "artstation/one/2019/Dragon_1.jpg" {
+		t.Fatalf("Expected %s, actual %s", "artstation/one/2019/Dragon_1.jpg", applied)
+	}
+	if undone != "artstation/one/a.jpg" {
+		t.Fatalf("Expected %s, actual %s", "artstation/one/a.jpg", undone)
+	}
+}
+
+func TestPlanSkipped(t *testing.T) {
+	// Arrange
+	dir, manifest, catalog := newArchive(t)
+	testutil.WriteFiles(t, dir, "artstation/one/c.jpg")
+	manifest.Add(artdl.ManifestEntry{Path: "artstation/one/c.jpg", Site: "artstation", User: "one"})
+	manifest.Add(artdl.ManifestEntry{Path: "artstation/one/d.jpg", URL: "https://example.com/d.jpg", Site: "artstation", User: "one"})
+
+	// Act
+	journal := planArchive(t, dir, manifest, catalog)
+
+	// Assert
+	if len(journal.Skipped) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(journal.Skipped))
+	}
+	skipped := map[string]bool{journal.Skipped[0].Path: true, journal.Skipped[1].Path: true}
+	if !skipped["artstation/one/c.jpg"] || !skipped["artstation/one/d.jpg"] {
+		t.Fatalf("Expected adopted and missing files to be skipped, actual %+v", journal.Skipped)
+	}
+}
@@ -2,15 +2,15 @@ package artstation
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mmcdole/gofeed"
 	artdl "github.com/vangroan/art-dl/common"
@@ -20,8 +20,10 @@ import (
 const (
 	GalleryRule      string = `www\.artstation\.com/(?P<userinfo>[a-zA-Z0-9_-]+)`
 	navigationLimit  int    = 9999
-	directory        string = "artstation"
+	layout           string = "{site}/{user}/{title}/{filename}"
+	siteName         string = "artstation"
 	concurrencyLevel int    = 8
+	galleryURLFmt    string = "https://www.artstation.com/%s"
 	rssURL           string = "https://www.artstation.com/%s.rss?page=3"
 	projectPattern   string = "https://www.artstation.com/artwork/(?P<projectid>[a-zA-Z0-9_-]+)"
 	projectIDKey     string = "projectid"
@@ -34,11 +36,12 @@ type ArtStationScraper struct {
 }
 
 // NewScraper creates a new deviantart scraper
-func NewScraper(id int, config *artdl.Config) artdl.Scraper {
+func NewScraper(id int, session *artdl.Session) artdl.Scraper {
 	return &ArtStationScraper{
 		BaseScraper: artdl.BaseScraper{
-			ID:     id,
-			Config: config,
+			ID:      id,
+			Config:  session.Config,
+			Session: session,
 		},
 	}
 }
@@ -56,10 +59,9 @@ func (s *ArtStationScraper) Run(wg *sync.WaitGroup, matches []artdl.RuleMatch) e
 	cancel := make(chan struct{})
 	defer close(cancel)
 
-	seeds := seedGalleries(matches...)
-	usernames := ensureExistsStage(cancel, seeds)
-	projectURLs := fetchRssStage(cancel, usernames)
-	filenames := fetchProjectStage(cancel, projectURLs, 0)
+	usernames := seedGalleries(matches...)
+	projectURLs := fetchRssStage(cancel, usernames, s.Session)
+	filenames := fetchProjectStage(cancel, projectURLs, 0, s.Session)
 
 	for filename := range filenames {
 		log.Println("Done:", filename)
@@ -81,6 +83,11 @@ func (s *ArtStationScraper) Run(wg *sync.WaitGroup, matches []artdl.RuleMatch) e
 	return nil
 }
 
+// GalleryURL returns the URL of the user's gallery.
+func GalleryURL(username string) string {
+	return fmt.Sprintf(galleryURLFmt, username)
+}
+
 // seedGalleries takes the matched rules and generates
 // a stream of gallery usernames.
 func seedGalleries(matches ...artdl.RuleMatch) <-chan string {
@@ -100,35 +107,18 @@ func seedGalleries(matches ...artdl.RuleMatch) <-chan string {
 	return out
 }
 
-// ensureExistsStage creates an empty directory for
-// the user gallery if it doesn't exist.
-func ensureExistsStage(cancel <-chan struct{}, usernames <-chan string) <-chan string {
-	out := make(chan string)
-
-	go func() {
-		defer close(out)
-
-		for username := range usernames {
-			_ = os.MkdirAll(filepath.Join(directory, username), os.ModePerm)
-
-			select {
-			// Forward command
-			case out <- username:
-			case <-cancel:
-				return
-			}
-		}
-	}()
-
-	return out
-}
-
 // fetchRssStage is a pipeline stage that retrieves RSS documents
 // and feeds them into an output channel.
-func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downloadCommand {
+//
+// Tells the session whether each gallery was listed to the end,
+// for mirrored runs.
+func fetchRssStage(cancel <-chan struct{}, usernames <-chan string, session *artdl.Session) <-chan downloadCommand {
 	out := make(chan downloadCommand)
+	client := session.Client(siteName)
 
 	go func() {
+		defer close(out)
+
 	USERS:
 		for username := range usernames {
 
@@ -141,12 +131,15 @@ func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downl
 				rssURL, err := makeRssURL(username, offset)
 				if err != nil {
 					log.Println("Error:", err)
+					session.Listed(siteName, username, err)
+					continue USERS
 				}
 
-				items, err := fetchRss(rssURL.String())
+				items, err := fetchRss(client, rssURL.String())
 
 				if err != nil {
 					log.Println("Error:", err)
+					session.Listed(siteName, username, err)
 					continue USERS
 				}
 
@@ -162,11 +155,16 @@ func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downl
 					// Continue navigating
 					offset += len(items)
 				} else {
+					session.Listed(siteName, username, nil)
 					break FETCHING
 				}
 
 			}
 
+			if offset >= navigationLimit {
+				session.Listed(siteName, username, fmt.Errorf("listing truncated at %d items", navigationLimit))
+			}
+
 		}
 	}()
 
@@ -176,11 +174,12 @@ func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downl
 // fetchRss retrieves the RSS XML document from the url.
 //
 // Returns the page URLs of projects.
-func fetchRss(u string) ([]string, error) {
+func fetchRss(client *http.Client, u string) ([]string, error) {
 	log.Println("Fetching RSS Feed:", u)
 
 	// Retrieve RSS feed
 	fp := gofeed.NewParser()
+	fp.Client = client
 	feed, err := fp.ParseURL(u)
 	if err != nil {
 		return nil, err
@@ -204,7 +203,7 @@ func fetchRss(u string) ([]string, error) {
 
 // fetchProjectStage is a pipeline stage that will retrieve
 // the HTML page of the project.
-func fetchProjectStage(cancel <-chan struct{}, commands <-chan downloadCommand, id int) <-chan string {
+func fetchProjectStage(cancel <-chan struct{}, commands <-chan downloadCommand, id int, session *artdl.Session) <-chan string {
 	out := make(chan string)
 
 	// Regex to extract project identifier from page URL.
@@ -214,7 +213,14 @@ func fetchProjectStage(cancel <-chan struct{}, commands <-chan downloadCommand,
 	go func() {
 		defer close(out)
 
+		// Set when the run can't continue
+		stopped := false
+
 		for cmd := range commands {
+			if stopped {
+				return
+			}
+
 			// Wrap in function to call defers
 			func() {
 				// URL is for project HTML page, but we need to convert
@@ -230,54 +236,98 @@ func fetchProjectStage(cancel <-chan struct{}, commands <-chan downloadCommand,
 
 				if projectID == "" {
 					log.Println("Warning: Failed to extract project ID from ", cmd.url)
+					session.Listed(siteName, cmd.username, fmt.Errorf("no project ID in %s", cmd.url))
 					return
 				}
 
 				jsonURL := fmt.Sprintf(projectAPIURL, projectID)
 				log.Println("Downloading JSON ", jsonURL)
 
+				// The API is called by the project page, and
+				// so are the images it references.
+				headers := http.Header{"Referer": []string{cmd.url}}
+
 				// Download json
-				r, err := http.Get(jsonURL)
+				req, err := http.NewRequest(http.MethodGet, jsonURL, nil)
+				if err != nil {
+					log.Println("Warning: Failed to create project JSON request: ", err)
+					session.Listed(siteName, cmd.username, err)
+					return
+				}
+				req.Header = headers.Clone()
+
+				r, err := session.Client(siteName).Do(req)
 				if err != nil {
 					log.Println("Warning: Failed to fetch project page JSON: ", err)
+					session.Listed(siteName, cmd.username, err)
 					return
 				}
 				defer r.Body.Close()
 
-				// Deserialize JSON
+				// Deserialize JSON, keeping the raw document
+				// for sidecars.
+				var raw json.RawMessage
 				var data ProjectData
-				err = json.NewDecoder(r.Body).Decode(&data)
+				err = json.NewDecoder(r.Body).Decode(&raw)
+				if err == nil {
+					err = json.Unmarshal(raw, &data)
+				}
 				if err != nil {
 					log.Println("Warning: Failed to decode JSON: ", err)
+					session.Listed(siteName, cmd.username, err)
 					return
 				}
 
-				// Each project gets a folder in the user's directory.
-				projectDirname := artdl.SanitizeDirname(data.Title)
-
-				for _, asset := range data.Assets {
-					// Wrap in function to call defers
-					func() {
-						if asset.ImageUrl != "" {
-							log.Println("Downloading Image ", asset.ImageUrl)
-							r, err := http.Get(asset.ImageUrl)
-							if err != nil {
-								log.Println("Warnining: Failed downloading image ", asset.ImageUrl)
-								return
-							}
-							defer r.Body.Close()
-
-							filepath := downloadProjectImage(cmd.username, projectDirname, asset.ImageUrl)
-
-							select {
-							case out <- filepath:
-							case <-cancel:
-								return
-							}
-						} else {
-							log.Println("Warning: Asset image URL is empty")
-						}
-					}()
+				// Timestamps are RFC 3339. When missing or malformed
+				// the server's Last-Modified is used instead.
+				published, _ := time.Parse(time.RFC3339, data.PublishedAt)
+
+				for i, assetData := range data.Assets {
+					if assetData.ImageUrl == "" {
+						log.Println("Warning: Asset image URL is empty")
+						continue
+					}
+
+					log.Println("Downloading Image ", assetData.ImageUrl)
+					asset := artdl.Asset{
+						URL:         assetData.ImageUrl,
+						Site:        siteName,
+						User:        cmd.username,
+						ArtworkID:   projectID,
+						Index:       i + 1,
+						Title:       data.Title,
+						Description: data.Description,
+						Tags:        data.Tags,
+						PageURL:     cmd.url,
+						Width:       assetData.Width,
+						Height:      assetData.Height,
+						Published:   published,
+						Headers:     headers,
+						Source:      raw,
+					}
+
+					key, err := session.Download(&asset, layout)
+					if artdl.IsSkipped(err) {
+						log.Printf("Worker [%d] Skipped: %s", id, err)
+						continue
+					}
+					if errors.Is(err, artdl.ErrDiskSpace) {
+						log.Printf("Worker [%d] Stopping: %s", id, err)
+						// The rest of the project is never seen
+						session.Listed(siteName, cmd.username, err)
+						stopped = true
+						return
+					}
+					if err != nil {
+						log.Printf("Worker [%d] Warning: %s", id, err)
+						continue
+					}
+
+					select {
+					case out <- key:
+					case <-cancel:
+						return
+					}
 				}
 			}()
 		}
@@ -286,22 +336,6 @@ func fetchProjectStage(cancel <-chan struct{}, commands <-chan downloadCommand,
 	return out
 }
 
-func downloadProjectImage(username string, project string, url string) string {
-	dir := filepath.Join(directory, username, project)
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		log.Println("Error: ", err)
-	}
-
-	filepath, err := artdl.DownloadFile(url, dir, true)
-	if err != nil {
-		log.Printf("Worker [%d] Warning: %s", 0, err)
-		return ""
-	}
-
-	return filepath
-}
-
 type downloadCommand struct {
 	url      string
 	username string
@@ -327,10 +361,15 @@ func makeRssURL(username string, offset int) (*url.URL, error) {
 }
 
 type ProjectData struct {
-	Title  string      `json:"title"`
-	Assets []AssetData `json:"assets"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	PublishedAt string      `json:"published_at"`
+	Tags        []string    `json:"tags"`
+	Assets      []AssetData `json:"assets"`
 }
 
 type AssetData struct {
 	ImageUrl string `json:"image_url"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
 }
@@ -1,10 +1,13 @@
 package deviantart
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"regexp"
 	"strconv"
 	"sync"
 
@@ -15,7 +18,8 @@ import (
 const (
 	GalleryRule      string = `www\.deviantart\.com/(?P<userinfo>[a-zA-Z0-9_-]+)`
 	navigationLimit  int    = 9999
-	directory        string = "deviantart"
+	layout           string = "{site}/{user}/{filename}"
+	siteName         string = "deviantart"
 	concurrencyLevel int    = 8
 	galleryURLFmt    string = "https://www.deviantart.com/%s/gallery"
 	rssURL           string = "http://backend.deviantart.com/rss.xml"
@@ -27,11 +31,12 @@ type DeviantArtScraper struct {
 }
 
 // NewScraper creates a new deviantart scraper
-func NewScraper(id int, config *artdl.Config) artdl.Scraper {
+func NewScraper(id int, session *artdl.Session) artdl.Scraper {
 	return &DeviantArtScraper{
 		BaseScraper: artdl.BaseScraper{
-			ID:     id,
-			Config: config,
+			ID:      id,
+			Config:  session.Config,
+			Session: session,
 		},
 	}
 }
@@ -49,9 +54,8 @@ func (s *DeviantArtScraper) Run(wg *sync.WaitGroup, matches []artdl.RuleMatch) e
 	cancel := make(chan struct{})
 	defer close(cancel)
 
-	seeds := seedGalleries(matches...)
-	usernames := ensureExistsStage(cancel, seeds)
-	downloadCommands := fetchRssStage(cancel, usernames)
+	usernames := seedGalleries(matches...)
+	downloadCommands := fetchRssStage(cancel, usernames, s.Session)
 
 	filenames := make([]<-chan string, 0)
 	for i := 0; i < concurrencyLevel; i++ {
@@ -59,7 +63,7 @@ func (s *DeviantArtScraper) Run(wg *sync.WaitGroup, matches []artdl.RuleMatch) e
 		// download worker ID by scraper's ID and expected number
 		// of downloaders.
 		id := s.ID*concurrencyLevel + i
-		filenames = append(filenames, downloadStage(cancel, downloadCommands, id))
+		filenames = append(filenames, downloadStage(cancel, downloadCommands, id, s.Session))
 	}
 
 	for filename := range artdl.MergeStrings(cancel, filenames...) {
@@ -69,6 +73,11 @@ func (s *DeviantArtScraper) Run(wg *sync.WaitGroup, matches []artdl.RuleMatch) e
 	return nil
 }
 
+// GalleryURL returns the URL of the user's gallery.
+func GalleryURL(username string) string {
+	return fmt.Sprintf(galleryURLFmt, username)
+}
+
 // seedGalleries takes the matched rules and generates
 // a stream of gallery usernames.
 func seedGalleries(matches ...artdl.RuleMatch) <-chan string {
@@ -88,33 +97,14 @@ func seedGalleries(matches ...artdl.RuleMatch) <-chan string {
 	return out
 }
 
-// ensureExistsStage creates an empty directory for
-// the user gallery if it doesn't exist.
-func ensureExistsStage(cancel <-chan struct{}, usernames <-chan string) <-chan string {
-	out := make(chan string)
-
-	go func() {
-		defer close(out)
-
-		for username := range usernames {
-			_ = os.MkdirAll(filepath.Join(directory, username), os.ModePerm)
-
-			select {
-			// Forward command
-			case out <- username:
-			case <-cancel:
-				return
-			}
-		}
-	}()
-
-	return out
-}
-
 // fetchRssStage is a pipeline stage that retrieves RSS documents
 // and feeds them into an output channel.
-func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downloadCommand {
+//
+// Tells the session whether each gallery was listed to the end,
+// for mirrored runs.
+func fetchRssStage(cancel <-chan struct{}, usernames <-chan string, session *artdl.Session) <-chan downloadCommand {
 	out := make(chan downloadCommand)
+	client := session.Client(siteName)
 
 	go func() {
 		defer close(out)
@@ -131,18 +121,24 @@ func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downl
 				rssURL, err := makeRssURL(username, offset)
 				if err != nil {
 					log.Println("Error:", err)
+					session.Listed(siteName, username, err)
+					continue USERS
 				}
 
-				items, err := fetchRss(rssURL.String())
+				items, err := fetchRss(client, rssURL.String())
 
 				if err != nil {
 					log.Println("Error:", err)
+					session.Listed(siteName, username, err)
 					continue USERS
 				}
 
 				for _, item := range items {
+					item.Site = siteName
+					item.User = username
+
 					select {
-					case out <- downloadCommand{username: username, url: item}:
+					case out <- downloadCommand{username: username, asset: item}:
 					case <-cancel:
 						return
 					}
@@ -152,11 +148,16 @@ func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downl
 					// Continue navigating
 					offset += len(items)
 				} else {
+					session.Listed(siteName, username, nil)
 					break FETCHING
 				}
 
 			}
 
+			if offset >= navigationLimit {
+				session.Listed(siteName, username, fmt.Errorf("listing truncated at %d items", navigationLimit))
+			}
+
 		}
 	}()
 
@@ -165,12 +166,13 @@ func fetchRssStage(cancel <-chan struct{}, usernames <-chan string) <-chan downl
 
 // fetchRss retrieves the RSS XML document from the url.
 //
-// Returns the image URLs conatined in the feed.
-func fetchRss(u string) ([]string, error) {
+// Returns the image assets conatined in the feed.
+func fetchRss(client *http.Client, u string) ([]artdl.Asset, error) {
 	log.Println("Fetching RSS Feed:", u)
 
 	// Retrieve RSS feed
 	fp := gofeed.NewParser()
+	fp.Client = client
 	feed, err := fp.ParseURL(u)
 	if err != nil {
 		return nil, err
@@ -178,15 +180,26 @@ func fetchRss(u string) ([]string, error) {
 
 	log.Println("Feed :", feed.Title)
 
-	result := make([]string, 0)
+	result := make([]artdl.Asset, 0)
 
 	// Schedule Image Downloads
 	for _, item := range feed.Items {
 		if media, ok := item.Extensions["media"]; ok {
 			if content, ok := media["content"]; ok {
 				if len(content) > 0 {
-					if contentURL, ok := content[0].Attrs["url"]; ok {
-						result = append(result, contentURL)
+					if _, ok := content[0].Attrs["url"]; ok {
+						asset := mediaAsset(content[0].Attrs)
+						asset.ArtworkID = deviationID(item.Link)
+						asset.Index = 1
+						asset.Title = item.Title
+						asset.Description = item.Description
+						asset.Tags = item.Categories
+						asset.PageURL = item.Link
+						asset.Source, _ = json.Marshal(item)
+						if item.PublishedParsed != nil {
+							asset.Published = *item.PublishedParsed
+						}
+						result = append(result, asset)
 					} else {
 						log.Println("Warning: RSS feed item 'media:content' has no child URL", feed.Title)
 					}
@@ -204,33 +217,70 @@ func fetchRss(u string) ([]string, error) {
 	return result, nil
 }
 
+// mediaAsset creates an asset from the attributes of
+// a 'media:content' element.
+func mediaAsset(attrs map[string]string) artdl.Asset {
+	asset := artdl.Asset{
+		URL:         attrs["url"],
+		ContentType: attrs["type"],
+	}
+
+	// Optional attributes. Malformed values are left unknown.
+	asset.Width, _ = strconv.Atoi(attrs["width"])
+	asset.Height, _ = strconv.Atoi(attrs["height"])
+	asset.Size, _ = strconv.ParseInt(attrs["fileSize"], 10, 64)
+
+	return asset
+}
+
+// deviationRegex matches the identifier at the end of a deviation's
+// page URL, eg. "123456789" in ".../art/Title-123456789".
+var deviationRegex = regexp.MustCompile(`-(\d+)$`)
+
+// deviationID extracts the identifier of a deviation from its
+// page URL. Returns an empty string when there is none.
+func deviationID(link string) string {
+	if m := deviationRegex.FindStringSubmatch(link); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
 type downloadCommand struct {
-	url      string
+	asset    artdl.Asset
 	username string
 }
 
 // downloadStage is a pipeline stage that takes a channel of download commands
-// and downloads the images to the target directory.
+// and downloads the images into the storage.
 //
-// Returns a channel of filepaths to the downloaded files.
-func downloadStage(cancel <-chan struct{}, commands <-chan downloadCommand, id int) <-chan string {
+// Returns a channel of storage keys of the downloaded files.
+func downloadStage(cancel <-chan struct{}, commands <-chan downloadCommand, id int, session *artdl.Session) <-chan string {
 	out := make(chan string)
 
 	go func() {
 		defer close(out)
 
 		for cmd := range commands {
-			log.Printf("Worker [%d] Downloading %s", id, cmd.url)
+			log.Printf("Worker [%d] Downloading %s", id, cmd.asset.URL)
 
-			dir := filepath.Join(directory, cmd.username)
-			filepath, err := artdl.DownloadFile(cmd.url, dir, true)
+			key, err := session.Download(&cmd.asset, layout)
+			if artdl.IsSkipped(err) {
+				log.Printf("Worker [%d] Skipped: %s", id, err)
+				continue
+			}
+			if errors.Is(err, artdl.ErrDiskSpace) {
+				log.Printf("Worker [%d] Stopping: %s", id, err)
+				session.Listed(siteName, cmd.username, err)
+				return
+			}
 			if err != nil {
 				log.Printf("Worker [%d] Warning: %s", id, err)
 				continue
 			}
 
 			select {
-			case out <- filepath:
+			case out <- key:
 			case <-cancel:
 				return
 			}
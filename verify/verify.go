@@ -0,0 +1,215 @@
+// Package verify checks that the files of an archive are still
+// the ones that were downloaded.
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/processors"
+)
+
+const (
+	// Missing files are in the manifest but not on disk.
+	Missing string = "missing"
+
+	// Corrupt files differ from what was downloaded, or can't
+	// be decoded.
+	Corrupt string = "corrupt"
+
+	// CorruptDirname is the folder in the root of the output
+	// directory that repairs move corrupt files to.
+	CorruptDirname string = ".corrupt"
+
+	// corruptTimeLayout names the folder of each repair
+	corruptTimeLayout string = "20060102-150405"
+)
+
+// Problem is a manifest entry whose file is missing or corrupt.
+type Problem struct {
+	Entry  artdl.ManifestEntry
+	Kind   string
+	Reason string
+}
+
+// Report holds the outcome of verifying an archive.
+type Report struct {
+	// Checked is the number of manifest entries checked
+	Checked int
+
+	Problems []Problem
+
+	// Untracked are the files on disk that aren't in the manifest,
+	// relative to the output directory using forward slashes.
+	Untracked []string
+}
+
+// Archive checks each file in the manifest of the output directory.
+// A file must be present, have the recorded size, hash to the
+// checksum in the catalog and decode cleanly when it's an image.
+// Sizes and checksums that weren't recorded aren't checked, and the
+// catalog may be nil.
+//
+// Files removed as duplicates aren't expected on disk.
+func Archive(directory string, manifest *artdl.Manifest, catalog *artdl.Catalog) (*Report, error) {
+	report := &Report{}
+	tracked := make(map[string]bool)
+
+	for _, entry := range manifest.Entries() {
+		tracked[entry.Path] = true
+		if entry.DuplicateOf != "" {
+			continue
+		}
+
+		report.Checked++
+
+		var checksum string
+		if record, ok := catalog.FindPath(entry.Path); ok {
+			checksum = record.SHA256
+		}
+
+		fp := filepath.Join(directory, filepath.FromSlash(entry.Path))
+		kind, err := File(fp, entry.Size, checksum)
+		if err != nil {
+			report.Problems = append(report.Problems, Problem{Entry: entry, Kind: kind, Reason: err.Error()})
+		}
+	}
+
+	err := artdl.WalkArchive(directory, func(fp string, info os.FileInfo) error {
+		if strings.HasSuffix(fp, artdl.SidecarSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(directory, fp)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); !tracked[key] {
+			report.Untracked = append(report.Untracked, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Entry.Path < report.Problems[j].Entry.Path
+	})
+	sort.Strings(report.Untracked)
+
+	return report, nil
+}
+
+// File checks a single file against its recorded size and SHA-256
+// checksum, either of which may be empty, and decodes it when it's
+// an image.
+//
+// Returns the kind of problem found, if any.
+func File(fp string, size int64, checksum string) (string, error) {
+	info, err := os.Stat(fp)
+	if os.IsNotExist(err) {
+		return Missing, fmt.Errorf("file not found")
+	}
+	if err != nil {
+		return Missing, err
+	}
+
+	if size > 0 && info.Size() != size {
+		return Corrupt, fmt.Errorf("size is %d bytes, expected %d", info.Size(), size)
+	}
+
+	if checksum != "" {
+		actual, err := hashFile(fp)
+		if err != nil {
+			return Corrupt, err
+		}
+		if actual != checksum {
+			return Corrupt, fmt.Errorf("checksum is %s, expected %s", actual, checksum)
+		}
+	}
+
+	if processors.IsThumbnailable(fp) {
+		if err := decodeFile(fp); err != nil {
+			return Corrupt, fmt.Errorf("failed to decode image: %s", err)
+		}
+	}
+
+	return "", nil
+}
+
+func hashFile(fp string) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// decodeFile decodes the whole image, since truncated files often
+// have an intact header.
+func decodeFile(fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = image.Decode(f)
+	return err
+}
+
+// Repair prepares the problems to be downloaded again. Corrupt
+// files are moved into the corrupt folder, and the entries of the
+// problems are taken out of the manifest and catalog, so the files
+// no longer count as downloaded and the new downloads replace them
+// wherever they're laid out. The manifest is saved.
+//
+// Files without a URL, eg. adopted files that weren't matched to an
+// asset, can't be downloaded again and are left as they are.
+//
+// Returns the problems to download again.
+func Repair(directory string, manifest *artdl.Manifest, catalog *artdl.Catalog, problems []Problem) ([]Problem, error) {
+	stamp := time.Now().Format(corruptTimeLayout)
+	repairs := make([]Problem, 0, len(problems))
+
+	for _, problem := range problems {
+		if problem.Entry.URL == "" {
+			continue
+		}
+
+		if problem.Kind == Corrupt {
+			src := filepath.Join(directory, filepath.FromSlash(problem.Entry.Path))
+			dst := filepath.Join(directory, CorruptDirname, stamp, filepath.FromSlash(problem.Entry.Path))
+			if err := artdl.MoveFile(src, dst); err != nil {
+				return nil, fmt.Errorf("failed to move '%s' to '%s': %s", src, dst, err)
+			}
+		}
+
+		manifest.Remove(problem.Entry.Path)
+		if err := catalog.Removed(problem.Entry.Path); err != nil {
+			return nil, err
+		}
+
+		repairs = append(repairs, problem)
+	}
+
+	return repairs, manifest.Save()
+}
@@ -0,0 +1,219 @@
+package verify
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	artdl "github.com/vangroan/art-dl/common"
+	"github.com/vangroan/art-dl/internal/testutil"
+)
+
+func encodePNG(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchive(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	good := encodePNG(t)
+	files := map[string][]byte{
+		"deviantart/one/good.png":      good,
+		"deviantart/one/truncated.png": good[:len(good)/2],
+		"deviantart/one/changed.png":   good,
+		"deviantart/one/resized.png":   good,
+	}
+	for key, data := range files {
+		testutil.WriteFile(t, filepath.Join(dir, filepath.FromSlash(key)), data)
+	}
+	testutil.WriteFile(t, filepath.Join(dir, "deviantart", "one", "extra.jpg"), []byte("extra"))
+
+	manifest := artdl.NewManifest()
+	for key, data := range files {
+		manifest.Add(artdl.ManifestEntry{Path: key, Site: "deviantart", User: "one", Size: int64(len(data))})
+	}
+	manifest.Add(artdl.ManifestEntry{Path: "deviantart/one/missing.png", Site: "deviantart", User: "one"})
+	manifest.Add(artdl.ManifestEntry{Path: "deviantart/one/dupe.png", DuplicateOf: "deviantart/one/good.png"})
+	manifest.Add(artdl.ManifestEntry{Path: "deviantart/one/resized.png", Size: 1})
+
+	catalog, err := artdl.OpenCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	asset := artdl.Asset{URL: "https://example.com/changed.png", Site: "deviantart", User: "one"}
+	if err := catalog.Seen(&asset); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.Stored(asset.URL, "deviantart/one/changed.png", int64(len(good)), "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	report, err := Archive(dir, manifest, catalog)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 5 {
+		t.Fatalf("Expected %d, actual %d", 5, report.Checked)
+	}
+
+	expected := []struct{ path, kind string }{
+		{"deviantart/one/changed.png", Corrupt},
+		{"deviantart/one/missing.png", Missing},
+		{"deviantart/one/resized.png", Corrupt},
+		{"deviantart/one/truncated.png", Corrupt},
+	}
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, actual %+v", len(expected), report.Problems)
+	}
+	for i, problem := range report.Problems {
+		if problem.Entry.Path != expected[i].path || problem.Kind != expected[i].kind {
+			t.Fatalf("Expected %s %s, actual %s %s", expected[i].kind, expected[i].path, problem.Kind, problem.Entry.Path)
+		}
+	}
+
+	if len(report.Untracked) != 1 || report.Untracked[0] != "deviantart/one/extra.jpg" {
+		t.Fatalf("Expected %v, actual %v", []string{"deviantart/one/extra.jpg"}, report.Untracked)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	testutil.WriteFiles(t, dir, "deviantart/one/a.png", "deviantart/one/c.png")
+	manifest := artdl.NewManifest()
+	problems := []Problem{
+		{Entry: artdl.ManifestEntry{Path: "deviantart/one/a.png", URL: "https://example.com/a.png", Site: "deviantart", User: "one"}, Kind: Corrupt},
+		{Entry: artdl.ManifestEntry{Path: "deviantart/one/b.png", URL: "https://example.com/b.png", Site: "deviantart", User: "one"}, Kind: Missing},
+		// Adopted files without a URL can't be downloaded again
+		{Entry: artdl.ManifestEntry{Path: "deviantart/one/c.png", Site: "deviantart", User: "one"}, Kind: Corrupt},
+	}
+	for _, problem := range problems {
+		manifest.Add(problem.Entry)
+	}
+
+	// Act
+	repairs, err := Repair(dir, manifest, nil, problems)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 2 {
+		t.Fatalf("Expected %d, actual %d", 2, len(repairs))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "deviantart", "one", "a.png")); !os.IsNotExist(err) {
+		t.Fatalf("Expected a.png to be moved")
+	}
+	moved, err := filepath.Glob(filepath.Join(dir, CorruptDirname, "*", "deviantart", "one", "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 {
+		t.Fatalf("Expected 1 file in %s, actual %d", CorruptDirname, len(moved))
+	}
+	if entries := manifest.Entries(); len(entries) != 1 || entries[0].Path != "deviantart/one/c.png" {
+		t.Fatalf("Expected only c.png to stay in the manifest, actual %+v", entries)
+	}
+}
+
+func TestRepairIsClean(t *testing.T) {
+	// Arrange
+	good := encodePNG(t)
+	requested := make(map[string]int)
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requested[r.URL.Path]++
+		lock.Unlock()
+		w.Write(good)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	download := func(config *artdl.Config, names ...string) {
+		session, err := artdl.NewSession(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			asset := artdl.Asset{URL: server.URL + "/" + name, Site: "deviantart", User: "one"}
+			if _, err := session.Download(&asset, "{site}/{user}/{filename}"); err != nil && !artdl.IsSkipped(err) {
+				t.Fatal(err)
+			}
+		}
+		if err := session.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() *Report {
+		manifest, err := artdl.LoadManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		catalog, err := artdl.OpenCatalogReadOnly(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer catalog.Close()
+		report, err := Archive(dir, manifest, catalog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	download(&artdl.Config{Directory: dir}, "a.png", "b.png", "c.png")
+	testutil.WriteFile(t, filepath.Join(dir, "deviantart", "one", "a.png"), good[:len(good)/2])
+	if err := os.Remove(filepath.Join(dir, "deviantart", "one", "b.png")); err != nil {
+		t.Fatal(err)
+	}
+	report := check()
+	if len(report.Problems) != 2 {
+		t.Fatalf("Expected %d problems, actual %+v", 2, report.Problems)
+	}
+
+	// Act
+	manifest, err := artdl.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := artdl.OpenCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repairs, err := Repair(dir, manifest, catalog, report.Problems)
+	catalog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make(map[string]bool)
+	for _, problem := range repairs {
+		urls[problem.Entry.URL] = true
+	}
+	download(&artdl.Config{Directory: dir, URLs: urls}, "a.png", "b.png", "c.png")
+
+	// Assert
+	report = check()
+	if len(report.Problems) != 0 || len(report.Untracked) != 0 {
+		t.Fatalf("Expected a clean archive, actual %+v", report)
+	}
+	if requested["/c.png"] != 1 {
+		t.Fatalf("Expected c.png to be downloaded once, actual %d", requested["/c.png"])
+	}
+}